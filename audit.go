@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const DefaultAuditMaxLen = 10000
+
+// writeAudit appends a record of action on key to opt.AuditStream with XADD,
+// trimming the stream to about opt.AuditMaxLen entries. Writing is best
+// effort: errors are logged and never fail the lock. exitCode is recorded
+// only when it is not negative.
+func writeAudit(c *RedisConn, opt *Options, key string, token string, action string, exitCode int) {
+	if opt.AuditStream == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	args := []interface{}{opt.AuditStream}
+	if opt.AuditMaxLen > 0 {
+		args = append(args, "MAXLEN", "~", opt.AuditMaxLen)
+	}
+	args = append(args, "*",
+		"key", key,
+		"token", token,
+		"action", action,
+		"host", host,
+		"pid", strconv.Itoa(os.Getpid()),
+		"ts", strconv.FormatInt(time.Now().Unix(), 10),
+	)
+	if exitCode >= 0 {
+		args = append(args, "exit_code", fmt.Sprint(exitCode))
+	}
+	if r := c.Cmd("XADD", args...); r.Err != nil {
+		log.Printf("could not write the audit record to %s: %s\n", opt.AuditStream, r.Err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"strconv"
+	"strings"
+)
+
+const (
+	ClusterSlots        = 16384
+	MaxClusterRedirects = 5
+)
+
+// clusterState follows MOVED and ASK redirects of Redis Cluster for a
+// RedisConn, caching which node serves each slot.
+type clusterState struct {
+	slots  map[uint16]string
+	nodes  map[string]*RedisConn
+	served map[uint16]*RedisConn // the node which served the last command on each slot
+}
+
+func newClusterState() *clusterState {
+	return &clusterState{
+		slots:  make(map[uint16]string),
+		nodes:  make(map[string]*RedisConn),
+		served: make(map[uint16]*RedisConn),
+	}
+}
+
+// Cmd issues the command, following redirects with -cluster.
+func (c *RedisConn) Cmd(cmd string, args ...interface{}) *redis.Reply {
+	if c.dropped {
+		return &redis.Reply{Type: redis.ErrorReply, Err: ErrConnDropped}
+	}
+	if c.cluster == nil {
+		return c.Client.Cmd(cmd, args...)
+	}
+	node := c
+	key, hasKey := commandKey(cmd, args)
+	if hasKey {
+		if addr, ok := c.cluster.slots[keySlot(key)]; ok {
+			n, err := c.node(addr)
+			if err != nil {
+				return &redis.Reply{Type: redis.ErrorReply, Err: err}
+			}
+			node = n
+		}
+	}
+	r := node.Client.Cmd(cmd, args...)
+	for i := 0; i < MaxClusterRedirects; i++ {
+		kind, slot, addr, ok := parseRedirect(r)
+		if !ok {
+			break
+		}
+		n, err := c.node(addr)
+		if err != nil {
+			return &redis.Reply{Type: redis.ErrorReply, Err: err}
+		}
+		node = n
+		if kind == "MOVED" {
+			c.cluster.slots[slot] = addr
+		} else if r := node.Client.Cmd("ASKING"); r.Err != nil {
+			return r
+		}
+		r = node.Client.Cmd(cmd, args...)
+	}
+	if hasKey {
+		c.cluster.served[keySlot(key)] = node
+	}
+	return r
+}
+
+// keyNodes returns the connections to the nodes which served the last
+// commands on keys, without duplicates, for a command without a key which
+// must follow them on the same node, e.g. WAIT after SET. It is c itself
+// without -cluster.
+func (c *RedisConn) keyNodes(keys []string) []*RedisConn {
+	if c.cluster == nil {
+		return []*RedisConn{c}
+	}
+	var nodes []*RedisConn
+	seen := make(map[*RedisConn]bool)
+	for _, key := range keys {
+		node, ok := c.cluster.served[keySlot(key)]
+		if !ok {
+			node = c
+		}
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Close closes the connections to all the nodes. A dropped connection is
+// left to the cleanup using it.
+func (c *RedisConn) Close() error {
+	if c.dropped {
+		return nil
+	}
+	if c.cluster != nil {
+		for _, node := range c.cluster.nodes {
+			node.Client.Close()
+		}
+	}
+	return c.Client.Close()
+}
+
+// node returns the connection to the cluster node addr.
+func (c *RedisConn) node(addr string) (*RedisConn, error) {
+	if addr == c.opt.Redis {
+		return c, nil
+	}
+	if node, ok := c.cluster.nodes[addr]; ok {
+		return node, nil
+	}
+	o := *c.opt
+	o.Redis = addr
+	o.Cluster = false
+	node, err := dialRedis(&o)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to cluster node %s: %s", addr, err)
+	}
+	c.cluster.nodes[addr] = node
+	return node, nil
+}
+
+// parseRedirect parses a "MOVED slot host:port" or "ASK slot host:port"
+// error reply.
+func parseRedirect(r *redis.Reply) (kind string, slot uint16, addr string, ok bool) {
+	if r.Type != redis.ErrorReply || r.Err == nil {
+		return "", 0, "", false
+	}
+	f := strings.Fields(r.Err.Error())
+	if len(f) != 3 || (f[0] != "MOVED" && f[0] != "ASK") {
+		return "", 0, "", false
+	}
+	n, err := strconv.ParseUint(f[1], 10, 16)
+	if err != nil {
+		return "", 0, "", false
+	}
+	return f[0], uint16(n), f[2], true
+}
+
+// commandKey returns the (first) key of the command, if it has one.
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "INFO", "WAIT", "SCAN", "PING", "ASKING":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 || fmt.Sprint(args[1]) == "0" {
+			return "", false
+		}
+		return fmt.Sprint(args[2]), true
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return fmt.Sprint(args[0]), true
+}
+
+// keySlot returns the cluster slot of key, honoring {hash tags}.
+func keySlot(key string) uint16 {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return crc16([]byte(key)) % ClusterSlots
+}
+
+// crc16 is CRC16-CCITT (XMODEM), as used by Redis Cluster.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables of the options.
+const EnvPrefix = "REDIS_SETLOCK_"
+
+// EnvWait is the environment variable for -n and -N, which have no
+// variables of their own: false is -n, and true is -N.
+const EnvWait = EnvPrefix + "WAIT"
+
+// envFlags are the flags which can be given by the environment variables,
+// the configuration shared among invocations. Not the ones which switch the
+// mode (e.g. -gc, -release, -watch) or confirm it (-yes, -force), as a
+// variable left in the environment would turn every run into the mode, nor
+// the one letter flags, as -n and -N (or -x and -X) would be the same one.
+var envFlags = map[string]bool{
+	"redis": true, "auth": true, "db": true, "expires": true, "keep": true,
+	"wait-timeout": true, "refresh": true, "keys": true, "shared": true,
+	"slots": true, "exit-code-file": true, "result-file": true,
+	"local-addr": true, "tcp-nodelay": true, "tls": true, "tls-ca": true,
+	"tls-cert": true, "tls-key": true, "tls-skip-verify": true,
+	"max-acquire-latency": true, "release-delay": true,
+	"require-success": true, "require-success-max-age": true,
+	"set-success": true, "prefix": true, "cleanup-timeout": true,
+	"watch-interval": true, "watch-backoff-max": true, "max-restarts": true,
+	"log-format": true, "verbose": true, "quiet": true, "log-fd": true,
+	"require-ttl": true, "require-ttl-extend": true, "ready-pattern": true,
+	"ready-fd": true, "connect-timeout": true, "connect-backoff-max": true,
+	"pre-release": true, "keep-on-pre-release-failure": true,
+	"wait-replicas": true, "wait-replicas-timeout": true,
+	"resolve-once": true, "strict": true, "verify-release": true,
+	"no-stdin": true, "stdin-line": true, "statsd": true,
+	"statsd-prefix": true, "skip-if-locked": true, "on-locked": true,
+	"takeover-dead-holder": true, "token-include-version": true,
+	"fencing-key": true, "fencing": true, "fencing-fd": true,
+	"on-ambiguous-reply": true, "wait-key-absent": true,
+	"wrap-output-json": true, "max-runs": true, "window": true,
+	"redis-master": true, "redis-replica": true, "command-timeout": true,
+	"timeout-exit-code": true, "ttl-from-timeout": true, "ttl-margin": true,
+	"emit-loss-event": true, "signal-on-loss": true, "kill-timeout": true,
+	"interrupt-grace": true, "log-on": true, "acquire-command": true,
+	"release-command": true, "cluster": true, "sentinel": true,
+	"master-name": true, "skip-version-check": true, "audit-stream": true,
+	"audit-maxlen": true,
+}
+
+// envName returns the environment variable of the flag name, e.g.
+// REDIS_SETLOCK_WAIT_TIMEOUT for -wait-timeout.
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets the flags which were not given on the command line
+// from the environment variables, so that the flags win over the variables
+// and the variables over the defaults. Only envFlags have variables, and
+// not the aliases of a flag given (e.g. -verbose of -v).
+func setFlagsFromEnv() {
+	given := make(map[string]bool)
+	var values []flag.Value
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		values = append(values, f.Value)
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		if !envFlags[f.Name] || given[f.Name] {
+			return
+		}
+		for _, v := range values {
+			if v == f.Value {
+				return
+			}
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			usageError("invalid %s: %s", name, err)
+		}
+	})
+	if given["n"] || given["N"] {
+		return
+	}
+	if v := os.Getenv(EnvWait); v != "" {
+		wait, err := strconv.ParseBool(v)
+		if err != nil {
+			usageError("invalid %s: %s", EnvWait, err)
+		}
+		flag.Set("n", strconv.FormatBool(!wait))
+	}
+}
+
+// flagGiven tells whether the flag name was given, on the command line or by
+// its environment variable, rather than left to the default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given || envFlags[name] && os.Getenv(envName(name)) != ""
+}
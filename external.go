@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"log"
+	"os/exec"
+)
+
+// runExternal invokes the program holding a lock which is acquired and
+// released by -acquire-command and -release-command instead of Redis.
+//
+// Both commands are run by /bin/sh with SETLOCK_KEY and SETLOCK_TOKEN (a
+// random token unique to this invocation) in the environment. The lock is
+// acquired when -acquire-command exits zero, and is held by another when it
+// exits nonzero; it is retried with -N until -wait-timeout or a signal, or
+// given up with -n. The release command also gets the program's exit code
+// in SETLOCK_EXIT_CODE.
+func runExternal(opt *Options, key string, program string, args []string) int {
+	env := []string{
+		"SETLOCK_KEY=" + key,
+		"SETLOCK_TOKEN=" + setlock.NewToken(),
+	}
+	ctx, stop := signalContext()
+	_, err := setlock.Retry(ctx, retryOptions(opt, key), func() (bool, error) {
+		err := runHook(opt.AcquireCommand, env)
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil // held by another
+		}
+		return err == nil, err
+	})
+	if s := stop(); s != nil {
+		if err == nil && opt.ReleaseCommand != "" {
+			// the program is not run, so the lock is released even with -keep.
+			runHook(opt.ReleaseCommand, append(env, fmt.Sprintf("SETLOCK_EXIT_CODE=%d", signalExitCode(s))))
+		}
+		logSummary(opt, "warn", false, "%s: got signal %s while waiting for the lock", key, s)
+		return signalExitCode(s)
+	}
+	if err == setlock.ErrLocked {
+		logSummary(opt, lockFailureLevel(opt), false, "%s: %s", key, err)
+		return opt.ExitCode
+	} else if err != nil {
+		logEvent("error", key, err, "could not run -acquire-command")
+		return ExitCodeError
+	}
+
+	ran = true
+	code, _ := invokeCommand(opt, program, args, env, nil)
+	if opt.Keep || opt.ReleaseCommand == "" {
+		logSummary(opt, "info", code == 0, "%s: locked, exit code %d, lock kept", key, code)
+		return code
+	}
+	env = append(env, fmt.Sprintf("SETLOCK_EXIT_CODE=%d", code))
+	if err := runHook(opt.ReleaseCommand, env); err != nil {
+		log.Printf("-release-command failed: %s\n", err)
+	}
+	logSummary(opt, "info", code == 0, "%s: locked, exit code %d, lock released", key, code)
+	return code
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// fencingKey returns the counter key of the fencing token for key, or ""
+// without -fencing and -fencing-key. -fencing uses the companion key
+// KEY:fence.
+func fencingKey(opt *Options, key string) string {
+	if opt.FencingKey != "" {
+		return opt.FencingKey
+	}
+	if opt.Fencing {
+		return key + ":fence"
+	}
+	return ""
+}
+
+// fencingFiles returns the ExtraFiles of the command which make the file
+// descriptor fd (3 or larger) of the command a pipe to read fence from.
+func fencingFiles(fd int, fence int64) ([]*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// the pipe buffer is far larger than the number, so this never blocks.
+	_, err = fmt.Fprintf(w, "%d\n", fence)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("could not write the fencing token to -fencing-fd %d: %s", fd, err)
+	}
+	files := make([]*os.File, fd-2)
+	files[fd-3] = r
+	return files, nil
+}
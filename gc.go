@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"github.com/fzzy/radix/redis"
+	"log"
+	"strings"
+	"time"
+)
+
+const GCScanCount = 100
+
+// runGC removes the locks under opt.Prefix older than opt.OlderThan.
+// The age of a lock is the time of its holder, so the keys which do not hold
+// a holder (e.g. KEY:runs, KEY:readers, or a lock taken before the holder was
+// stored) are never removed.
+// It exits 0 when any lock was (or would be) removed, 1 when none, and
+// ExitCodeError when the scan or a removal failed.
+func runGC(opt *Options) int {
+	c, err := connectForProbe(opt)
+	if err != nil {
+		log.Printf("Redis server seems down: %s\n", err)
+		return ExitCodeError
+	}
+	defer c.Close()
+
+	var found, failed bool
+	cursor := "0"
+	for {
+		r := c.Cmd("SCAN", cursor, "MATCH", globEscape(opt.Prefix)+"*", "COUNT", GCScanCount)
+		if r.Err != nil {
+			log.Printf("SCAN failed: %s\n", r.Err)
+			return ExitCodeError
+		}
+		if r.Type != redis.MultiReply || len(r.Elems) != 2 {
+			log.Printf("unexpected SCAN reply: %s\n", r)
+			return ExitCodeError
+		}
+		cursor, _ = r.Elems[0].Str()
+		keys, _ := r.Elems[1].List()
+		for _, key := range keys {
+			r := c.Cmd("GET", key)
+			if isConnError(r.Err) {
+				log.Printf("GET %s failed: %s\n", key, r.Err)
+				return ExitCodeError
+			}
+			v, err := r.Str()
+			if err != nil {
+				continue // gone or not a string
+			}
+			h := setlock.ParseHolder(v)
+			if h.Time.IsZero() {
+				continue // not a lock
+			}
+			age := time.Now().Sub(h.Time).Truncate(time.Second)
+			if age < opt.OlderThan {
+				continue
+			}
+			if !opt.Yes {
+				ttl, _ := c.Cmd("TTL", key).Int()
+				fmt.Printf("would remove %s held by token %s (pid %d on %s), ttl %ds (age %s)\n", key, h.Token, h.PID, h.Host, ttl, age)
+				found = true
+				continue
+			}
+			removed, err := removeLock(c, key, v)
+			if err != nil {
+				log.Printf("could not remove %s: %s\n", key, err)
+				failed = true
+			} else if removed {
+				fmt.Printf("removed %s (age %s)\n", key, age)
+				found = true
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	switch {
+	case failed:
+		return ExitCodeError
+	case !found:
+		return 1
+	}
+	return 0
+}
+
+// removeLock deletes key only if it still holds v, the value read just
+// before, so a lock acquired in the meantime is never removed.
+func removeLock(c *RedisConn, key string, v string) (bool, error) {
+	n, err := c.Cmd("EVAL", setlock.UnlockLUAScript, 1, key, v).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// globEscape escapes the special characters of the glob pattern of SCAN
+// MATCH in s, so that the pattern matches s literally.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// OutputLine is a line of the command's output wrapped by -wrap-output-json.
+// A line which is not valid UTF-8 is base64 encoded, with Encoding "base64".
+type OutputLine struct {
+	Stream   string `json:"stream"`
+	Line     string `json:"line"`
+	Encoding string `json:"encoding,omitempty"`
+	Ts       string `json:"ts"`
+}
+
+// jsonLineWriter writes each line written to it as an OutputLine to w.
+// Writers of the streams sharing w must share mu.
+type jsonLineWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	stream string
+	buf    []byte
+}
+
+func newJSONLineWriter(w io.Writer, stream string, mu *sync.Mutex) *jsonLineWriter {
+	return &jsonLineWriter{w: w, mu: mu, stream: stream}
+}
+
+func (jw *jsonLineWriter) Write(p []byte) (int, error) {
+	jw.buf = append(jw.buf, p...)
+	for {
+		i := bytes.IndexByte(jw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := jw.emit(jw.buf[:i]); err != nil {
+			return 0, err
+		}
+		jw.buf = jw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line without a newline, if any.
+func (jw *jsonLineWriter) Flush() {
+	if len(jw.buf) == 0 {
+		return
+	}
+	if err := jw.emit(jw.buf); err != nil {
+		log.Println(err)
+	}
+	jw.buf = nil
+}
+
+func (jw *jsonLineWriter) emit(line []byte) error {
+	l := OutputLine{
+		Stream: jw.stream,
+		Ts:     time.Now().Format(time.RFC3339Nano),
+	}
+	if utf8.Valid(line) {
+		l.Line = string(line)
+	} else {
+		l.Line = base64.StdEncoding.EncodeToString(line)
+		l.Encoding = "base64"
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	_, err = jw.w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The verbosity of the log by -v and -q.
+const (
+	LogQuiet   = -1 // only the errors which make go-redis-setlock fail
+	LogNormal  = 0
+	LogVerbose = 1 // and the progress of locking, at level debug
+)
+
+// logLevel is the verbosity of our own log.
+var logLevel = LogNormal
+
+// errorLog is the log of the errors with -q, while the output of the log
+// package is discarded.
+var errorLog *log.Logger
+
+// jsonLog is the writer of the log with -log-format json, or nil for text.
+var jsonLog *jsonLogWriter
+
+// LogEntry is a line of the log with -log-format json.
+type LogEntry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// jsonLogWriter is the output of the log package which writes each message
+// as a LogEntry of level info. logEvent writes the entries with the other
+// fields through it.
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (jw *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	if err := jw.writeEntry(LogEntry{Level: "info", Msg: msg}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (jw *jsonLogWriter) writeEntry(e LogEntry) error {
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	// before marshalling, which escapes a secret with e.g. & or < so that
+	// redactWriter could not find it.
+	e.Msg, e.Key, e.Error = redact(e.Msg), redact(e.Key), redact(e.Error)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	_, err = jw.w.Write(append(b, '\n'))
+	return err
+}
+
+// logEvent logs the message about key with err. In text it is the same as
+// log.Printf of "message: err". Level debug is logged only with -v, and
+// only levels error and notice (an outcome which must be seen although it
+// is not a failure, e.g. a skipped run) are logged with -q.
+func logEvent(level string, key string, err error, format string, a ...interface{}) {
+	if level == "debug" && logLevel < LogVerbose {
+		return
+	}
+	if level != "error" && level != "notice" && logLevel == LogQuiet {
+		return
+	}
+	msg := fmt.Sprintf(format, a...)
+	if jsonLog == nil {
+		printf := log.Printf
+		if errorLog != nil {
+			printf = errorLog.Printf
+		}
+		if err != nil {
+			printf("%s: %s\n", msg, err)
+		} else {
+			printf("%s\n", msg)
+		}
+		return
+	}
+	e := LogEntry{Level: level, Msg: msg, Key: key}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	jsonLog.writeEntry(e)
+}
+
+// logError logs err which makes go-redis-setlock fail, even with -q.
+func logError(key string, err error) {
+	logEvent("error", key, nil, "%s", err)
+}
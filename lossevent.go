@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockedAt is the time the locks of the current run were acquired, and
+// lostKeys the ones of them reported lost, so that a lock lost on refresh
+// is not reported again on release.
+var (
+	lockedAt time.Time
+	lostKeys map[string]bool
+)
+
+// lockAcquired starts a run holding the locks.
+func lockAcquired() {
+	lockedAt = time.Now()
+	lostKeys = make(map[string]bool)
+}
+
+// LossEvent is the line written to -emit-loss-event when the lock was lost
+// while the program ran.
+type LossEvent struct {
+	Event      string `json:"event"` // always "lock_lost"
+	Key        string `json:"key"`
+	Token      string `json:"token"`
+	Reason     string `json:"reason"`
+	AcquiredAt string `json:"acquired_at"`
+	LostAt     string `json:"lost_at"`
+	HeldMS     int64  `json:"held_ms"`
+}
+
+// lockLost reports that the lock of key was found lost for reason: it is
+// counted as "lost" by -statsd, written to -emit-loss-event, and with
+// -signal-on-loss the signal is sent to ourselves, which forwards it to the
+// program as a trapped signal.
+func lockLost(opt *Options, key string, token string, reason string) {
+	if lostKeys[key] {
+		return
+	}
+	lostKeys[key] = true
+	stats.Incr("lost")
+	if opt.EmitLossEvent != "" {
+		if err := writeLossEvent(opt.EmitLossEvent, key, token, reason); err != nil {
+			logEvent("error", key, err, "could not write the loss event to %s", opt.EmitLossEvent)
+		}
+	}
+	if opt.SignalOnLoss != nil {
+		logEvent("warn", key, nil, "sending %s to the command as the lock %s was lost", opt.SignalOnLoss, key)
+		syscall.Kill(os.Getpid(), opt.SignalOnLoss.(syscall.Signal))
+	}
+}
+
+// writeLossEvent appends a LossEvent line to path, or writes it to stderr
+// if path is "-".
+func writeLossEvent(path string, key string, token string, reason string) error {
+	now := time.Now()
+	b, err := json.Marshal(LossEvent{
+		Event:      "lock_lost",
+		Key:        key,
+		Token:      token,
+		Reason:     reason,
+		AcquiredAt: lockedAt.Format(time.RFC3339Nano),
+		LostAt:     now.Format(time.RFC3339Nano),
+		HeldMS:     int64(now.Sub(lockedAt) / time.Millisecond),
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if path == "-" {
+		_, err = os.Stderr.Write(b)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// trapSignalNames are the names of TrapSignals for -signal-on-loss.
+var trapSignalNames = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"QUIT": syscall.SIGQUIT,
+}
+
+// parseTrapSignal parses the name of one of TrapSignals, e.g. TERM or
+// SIGTERM.
+func parseTrapSignal(name string) (os.Signal, error) {
+	if s, ok := trapSignalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("%s is not one of HUP, INT, TERM and QUIT", name)
+}
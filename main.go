@@ -1,242 +1,2064 @@
 package main
 
 import (
-	crand "crypto/rand"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
 	"github.com/fzzy/radix/redis"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
-	DefaultExpires  = 86400
+	DefaultExpires  = setlock.DefaultExpires
 	ExitCodeError   = 111
-	UnlockLUAScript = "if redis.call(\"get\",KEYS[1]) == ARGV[1]\nthen\nreturn redis.call(\"del\",KEYS[1])\nelse\nreturn 0\nend\n"
+	ExitCodeNotMet  = 112
+	ExitCodeUsage   = 2
+	ExitCodeTooMany = 113
+	CountLUAScript  = "local n = redis.call(\"incr\",KEYS[1])\nif n == 1\nthen\nredis.call(\"pexpire\",KEYS[1],ARGV[1])\nend\nreturn n\n"
 	Version         = "0.0.1"
-	RetryInterval   = time.Duration(500) * time.Millisecond
+	RetryInterval   = setlock.DefaultRetryInterval
+
+	DefaultCleanupTimeout = 30 * time.Second
+	DefaultWatchInterval  = 1 * time.Second
+	DefaultWatchBackoff   = 1 * time.Minute
+	CrashLoopWindow       = 10 * time.Second
+	DrainTimeout          = 3 * time.Second
+	DefaultBackoffMax     = 5 * time.Second
+	DefaultReplicaTimeout = 1 * time.Second
+	DefaultConnectTimeout = 3 * time.Second
+	VerifyReleaseRetries  = 5
+	ReleaseRetries        = 3
+	DefaultTimeoutGrace   = 10 * time.Second
+	DefaultTimeoutCode    = 124
+	MaxLockCheckTTL       = 100 // below ExitCodeError
+	LockCheckNoTTL        = 101 // a key without TTL, for -lock-check
+	DefaultTTLMargin      = 1 * time.Minute
 )
 
-var TrapSignals = []os.Signal{
-	syscall.SIGHUP,
-	syscall.SIGINT,
-	syscall.SIGTERM,
-	syscall.SIGQUIT}
+// SetupError is returned by dialRedis when the redis-server was reached but
+// refused to set up the connection (e.g. AUTH failed). It is not retried.
+type SetupError struct {
+	err error
+}
+
+func (e *SetupError) Error() string {
+	return e.err.Error()
+}
+
+var TrapSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGQUIT}
+
+// signalContext returns a context which is cancelled when any of TrapSignals
+// is received, so that waiting for the redis-server or a lock is given up at
+// once. stop stops trapping and returns the signal received, if any. It may
+// be called more than once.
+func signalContext() (ctx context.Context, stop func() os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, TrapSignals...)
+	var sig os.Signal
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case sig = <-signalCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() os.Signal {
+		signal.Stop(signalCh)
+		cancel()
+		<-done
+		return sig
+	}
+}
+
+// signalExitCode returns the exit code for the termination by s, 128 + the
+// signal number as a shell does.
+func signalExitCode(s os.Signal) int {
+	if sig, ok := s.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return ExitCodeError
+}
+
+type Options struct {
+	Redis    string
+	Username string
+	Password string
+	DB       int
+	Expires  int
+	Keep     bool
+	Wait     bool
+	ExitCode int
+	Slots    int
+
+	WaitTimeout time.Duration
+
+	ExitCodeFile string
+	LocalAddr    net.Addr
+	TCPNoDelay   bool
+	TLSConfig    *tls.Config
+
+	MaxAcquireLatency time.Duration
+	ReleaseDelay      time.Duration
+
+	RequireSuccess       string
+	RequireSuccessMaxAge time.Duration
+	SetSuccess           string
+
+	GC        bool
+	Prefix    string
+	OlderThan time.Duration
+	Yes       bool
+
+	CleanupTimeout time.Duration
+
+	Watch         bool
+	WatchInterval time.Duration
+	WatchBackoff  time.Duration
+	MaxRestarts   int
+
+	LogFD int
+
+	LockCheck bool
+	Who       bool
+	Check     bool
+
+	Release bool
+	Token   string
+	Force   bool
+	DryRun  bool
+
+	RequireTTL       int
+	RequireTTLExtend bool
+
+	ReadyPattern *regexp.Regexp
+	ReadyFD      int
+
+	ConnectBackoffMax time.Duration
+	ConnectTimeout    time.Duration
+
+	SelfTest bool
+
+	PreRelease              string
+	KeepOnPreReleaseFailure bool
+
+	WaitReplicas        int
+	WaitReplicasTimeout time.Duration
+
+	ResolveOnce bool
+
+	VerifyRelease bool
+	Strict        bool
+
+	StdinLine string
+	NoStdin   bool
+
+	Statsd       string
+	StatsdPrefix string
+
+	SkipIfLocked bool
+	OnLocked     string
+
+	FencingKey string
+	Fencing    bool
+	FencingFD  int
+
+	OnAmbiguousReply string
+
+	WaitKeyAbsent string
+
+	WrapOutputJSON bool
+
+	MaxRuns int
+	Window  time.Duration
+
+	Replicas []string
+
+	KillTimeout    time.Duration
+	InterruptGrace time.Duration
+
+	LogOn string
+
+	AcquireCommand string
+	ReleaseCommand string
+
+	Cluster bool
+
+	Sentinel   bool
+	MasterName string
+
+	SkipVersionCheck bool
+
+	AuditStream string
+	AuditMaxLen int
+
+	Refresh bool
+
+	Keys   []string
+	Shared bool
+
+	CommandTimeout  time.Duration
+	TimeoutExitCode int
+
+	TakeoverDeadHolder bool
+
+	TokenIncludeVersion bool
+
+	EmitLossEvent string
+	SignalOnLoss  os.Signal
+
+	ResultFile string
+}
+
+// skipped tells the last run was skipped by -skip-if-locked, which exits
+// zero as a run which succeeded, and ran that the program was run; they are
+// written to -result-file.
+var skipped, ran bool
+
+// RedisConn is a connection to the redis-server. It keeps the underlying
+// net.Conn to apply per command deadlines, and can be re-established.
+type RedisConn struct {
+	*redis.Client
+	conn    net.Conn
+	opt     *Options
+	cluster *clusterState
+	dropped bool // left to a cleanup which timed out, see runCleanup
+}
+
+// ErrConnDropped is the error of the commands on a dropped RedisConn.
+var ErrConnDropped = errors.New("the connection was dropped after a cleanup timed out")
+
+func main() {
+	log.SetOutput(redactWriter{os.Stderr})
+	rand.Seed(time.Now().UnixNano())
+	opt, key, program, args := parseOptions()
+	if opt.ResolveOnce {
+		if err := pinRedisAddr(opt); err != nil {
+			logError("", err)
+			os.Exit(ExitCodeError)
+		}
+	}
+	if opt.Statsd != "" {
+		var err error
+		if stats, err = NewStatsd(opt.Statsd, opt.StatsdPrefix); err != nil {
+			log.Printf("statsd is disabled: %s\n", err)
+		}
+	}
+	var code int
+	if opt.GC {
+		code = runGC(opt)
+	} else if opt.LockCheck {
+		code = runLockCheck(opt, key)
+	} else if opt.Who {
+		code = runWho(opt, key)
+	} else if opt.Check {
+		code = runCheck(opt, key)
+	} else if opt.Release {
+		code = runRelease(opt, key)
+	} else if opt.SelfTest {
+		code = runSelfTest(opt)
+	} else if opt.AcquireCommand != "" {
+		code = runExternal(opt, key, program, args)
+	} else {
+		code = run(opt, key, program, args)
+	}
+	if opt.ExitCodeFile != "" {
+		if err := writeFileAtomically(opt.ExitCodeFile, strconv.Itoa(code)); err != nil {
+			log.Printf("could not write exit code file: %s\n", err)
+		}
+	}
+	if opt.ResultFile != "" {
+		result := "failed"
+		if skipped {
+			result = "skipped"
+		} else if ran {
+			result = "ran"
+		}
+		if err := writeFileAtomically(opt.ResultFile, result); err != nil {
+			log.Printf("could not write result file: %s\n", err)
+		}
+	}
+	os.Exit(code)
+}
+
+func parseOptions() (opt *Options, key string, program string, args []string) {
+	var redis string
+	var expires int
+	var keep bool
+	var noDelay bool
+	var waitTimeout time.Duration
+	var delay bool
+	var exitZero bool
+	var exitNonZero bool
+	var showVersion bool
+	var slots int
+	var exitCodeFile string
+	var localAddr string
+	var tcpNoDelay bool
+	var useTLS bool
+	var tlsCA string
+	var tlsCert string
+	var tlsKey string
+	var tlsSkipVerify bool
+	var maxAcquireLatency time.Duration
+	var releaseDelay time.Duration
+	var requireSuccess string
+	var requireSuccessMaxAge time.Duration
+	var setSuccess string
+	var gc bool
+	var prefix string
+	var olderThan time.Duration
+	var yes bool
+	var dryRun bool
+	var cleanupTimeout time.Duration
+	var watch bool
+	var watchInterval time.Duration
+	var watchBackoff time.Duration
+	var maxRestarts int
+	var logFD int
+	var logFormat string
+	var verbose bool
+	var quiet bool
+	var lockCheck bool
+	var who bool
+	var check bool
+	var release bool
+	var token string
+	var force bool
+	var requireTTL int
+	var requireTTLExtend bool
+	var readyPattern string
+	var readyFD int
+	var connectBackoffMax time.Duration
+	var connectTimeout time.Duration
+	var selfTest bool
+	var preRelease string
+	var keepOnPreReleaseFailure bool
+	var waitReplicas int
+	var waitReplicasTimeout time.Duration
+	var resolveOnce bool
+	var verifyRelease bool
+	var strict bool
+	var stdinLine string
+	var noStdin bool
+	var statsd string
+	var statsdPrefix string
+	var skipIfLocked bool
+	var onLocked string
+	var fencingKey string
+	var fencing bool
+	var fencingFD int
+	var onAmbiguousReply string
+	var waitKeyAbsent string
+	var wrapOutputJSON bool
+	var maxRuns int
+	var window time.Duration
+	var redisMaster string
+	var replicas stringsFlag
+	var killTimeout time.Duration
+	var interruptGrace time.Duration
+	var logOn string
+	var acquireCommand string
+	var releaseCommand string
+	var cluster bool
+	var skipVersionCheck bool
+	var sentinel bool
+	var masterName string
+	var auditStream string
+	var auditMaxLen int
+	var password string
+	var db int
+	var refresh bool
+	var keys string
+	var shared bool
+	var commandTimeout time.Duration
+	var timeoutExitCode int
+	var takeoverDeadHolder bool
+	var tokenIncludeVersion bool
+	var ttlFromTimeout bool
+	var ttlMargin time.Duration
+	var emitLossEvent string
+	var signalOnLoss string
+	var resultFile string
+
+	flag.Usage = usage
+	flag.StringVar(&redis, "redis", "127.0.0.1:6379", "redis-server host:port")
+	flag.StringVar(&password, "auth", "", "Password to AUTH to the redis-server with. Defaults to $REDIS_PASSWORD.")
+	flag.IntVar(&db, "db", 0, "Database number to SELECT on the redis-server.")
+	flag.IntVar(&expires, "expires", DefaultExpires, "The lock will be auto-released after the expire time is reached.")
+	flag.BoolVar(&keep, "keep", false, "Keep the lock after invoked command exited.")
+	flag.DurationVar(&waitTimeout, "wait-timeout", 0, "Give up waiting for the lock, for the redis-server and for -wait-key-absent after the duration with -N. Defaults to waiting for the lock forever, and for the others up to -expires.")
+	flag.BoolVar(&refresh, "refresh", false, "Extend the lock to -expires every half of it while the command is running.")
+	flag.BoolVar(&noDelay, "n", false, "No delay. If KEY is locked by another process, go-redis-setlock gives up.")
+	flag.BoolVar(&delay, "N", true, "(Default.) Delay. If KEY is locked by another process, go-redis-setlock waits until it can obtain a new lock.")
+	flag.BoolVar(&exitZero, "x", false, "If KEY is locked, go-redis-setlock exits zero.")
+	flag.BoolVar(&exitNonZero, "X", true, "(Default.) If KEY is locked, go-redis-setlock prints an error message and exits nonzero.")
+	flag.StringVar(&keys, "keys", "", "Comma separated keys to lock all of, instead of KEY.")
+	flag.BoolVar(&shared, "shared", false, "Lock KEY shared with the other -shared processes. An exclusive lock of KEY waits until all of them released it, and vice versa.")
+	flag.IntVar(&slots, "slots", 0, "Lock the first available one of N keys KEY-0 .. KEY-(N-1). The acquired slot number is exported to the command as SETLOCK_SLOT.")
+	flag.StringVar(&exitCodeFile, "exit-code-file", "", "Write the exit code of go-redis-setlock to the file.")
+	flag.StringVar(&resultFile, "result-file", "", "Write the result of the run to the file: ran, skipped (by -skip-if-locked) or failed (not run).")
+	flag.StringVar(&localAddr, "local-addr", "", "Local IP address to connect to the redis-server from.")
+	flag.BoolVar(&tcpNoDelay, "tcp-nodelay", true, "Set TCP_NODELAY on the connection to the redis-server. -tcp-nodelay=false enables Nagle's algorithm.")
+	flag.BoolVar(&useTLS, "tls", false, "Connect to the redis-server over TLS.")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM file of the CA certificates to verify the redis-server with for -tls. Defaults to the system roots.")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM file of the client certificate for -tls.")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM file of the key of -tls-cert.")
+	flag.BoolVar(&tlsSkipVerify, "tls-skip-verify", false, "Do not verify the certificate of the redis-server for -tls. For testing only.")
+	flag.DurationVar(&maxAcquireLatency, "max-acquire-latency", 0, "Give up an attempt to lock when the redis-server does not respond within the duration.")
+	flag.DurationVar(&releaseDelay, "release-delay", 0, "Keep the lock for the duration after the command exited, before releasing it.")
+	flag.StringVar(&requireSuccess, "require-success", "", "Run only if the success marker key exists. Otherwise exits 112.")
+	flag.DurationVar(&requireSuccessMaxAge, "require-success-max-age", 0, "Treat the success marker of -require-success older than the duration as missing.")
+	flag.StringVar(&setSuccess, "set-success", "", "Set the success marker key when the command exited zero.")
+	flag.BoolVar(&gc, "gc", false, "Remove the locks under -prefix older than -older-than, instead of running a program. Dry run unless -yes.")
+	flag.StringVar(&prefix, "prefix", "", "Namespace prepended to KEY (and -keys), e.g. team1:. -gc removes the locks under it.")
+	flag.DurationVar(&olderThan, "older-than", 0, "Age of the locks to be removed by -gc.")
+	flag.BoolVar(&yes, "yes", false, "Actually remove the locks with -gc.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only report what -gc or -release would remove, even with -yes.")
+	flag.DurationVar(&cleanupTimeout, "cleanup-timeout", DefaultCleanupTimeout, "Give up releasing the lock and other cleanup after the command exited when it takes longer than the duration.")
+	flag.BoolVar(&watch, "watch", false, "Run the command again each time the lock is available, until a signal is received.")
+	flag.DurationVar(&watchInterval, "watch-interval", DefaultWatchInterval, "Pause between the runs in -watch mode.")
+	flag.DurationVar(&watchBackoff, "watch-backoff-max", DefaultWatchBackoff, "Upper limit of the pause in -watch mode while the command keeps failing quickly.")
+	flag.IntVar(&maxRestarts, "max-restarts", 0, "Stop -watch when the command failed quickly again after restarting it the times in a row, i.e. it runs N+1 times. 0 means no limit.")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of go-redis-setlock's own log, text or json. The command's stdout and stderr are not affected.")
+	flag.BoolVar(&verbose, "v", false, "Verbose. Log the progress of locking, such as each retry while waiting for the lock.")
+	flag.BoolVar(&verbose, "verbose", false, "Same as -v.")
+	flag.BoolVar(&quiet, "q", false, "Quiet. Log only the errors which make go-redis-setlock fail.")
+	flag.BoolVar(&quiet, "quiet", false, "Same as -q.")
+	flag.IntVar(&logFD, "log-fd", 2, "File descriptor to write go-redis-setlock's own log to. The command's stderr is not affected.")
+	flag.BoolVar(&who, "who", false, "Print the host, PID and time of the holder of KEY instead of running a program. Exits 1 if KEY is not locked.")
+	flag.BoolVar(&check, "check", false, "Try to lock KEY and release it at once instead of running a program. Exits 0 if it was available, and 111 (0 with -x) printing the holder if not.")
+	flag.BoolVar(&release, "release", false, "Remove the lock of KEY left by a dead holder instead of running a program, printing the holder. Requires -token or -force.")
+	flag.StringVar(&token, "token", "", "Remove the lock by -release only if it is held by the token (as printed by -who).")
+	flag.BoolVar(&force, "force", false, "Remove the lock by -release whoever holds it.")
+	flag.BoolVar(&lockCheck, "lock-check", false, "Exit with the remaining TTL seconds of KEY (clamped to 0..100) instead of running a program. Exits 101 when KEY has no TTL, and 111 on any error, even of the invocation.")
+	flag.IntVar(&requireTTL, "require-ttl", 0, "Run only if the lock has at least the seconds of TTL remaining after it was acquired. Otherwise exits 112.")
+	flag.BoolVar(&requireTTLExtend, "require-ttl-extend", false, "Extend the TTL to -require-ttl instead of refusing to run.")
+	flag.StringVar(&readyPattern, "ready-pattern", "", "Regexp matching a line of the command's stdout which tells the command is ready.")
+	flag.IntVar(&readyFD, "ready-fd", -1, "File descriptor to write \"ready\" when the command is ready by -ready-pattern.")
+	flag.DurationVar(&connectTimeout, "connect-timeout", DefaultConnectTimeout, "Give up an attempt to connect to the redis-server after the duration, also with -n. 0 means no limit.")
+	flag.DurationVar(&connectBackoffMax, "connect-backoff-max", DefaultBackoffMax, "Upper bound of the exponentially growing pause between attempts to connect to the redis-server.")
+	flag.BoolVar(&selfTest, "selftest", false, "Acquire, extend and release a temporary lock to verify the configuration, instead of running a program.")
+	flag.StringVar(&preRelease, "pre-release", "", "Shell command to run holding the lock after the command exited, before releasing the lock.")
+	flag.BoolVar(&keepOnPreReleaseFailure, "keep-on-pre-release-failure", false, "Keep the lock when the -pre-release command failed.")
+	flag.IntVar(&waitReplicas, "wait-replicas", 0, "Fail to lock unless the lock is replicated to the number of replicas (by WAIT).")
+	flag.DurationVar(&waitReplicasTimeout, "wait-replicas-timeout", DefaultReplicaTimeout, "How long to wait for -wait-replicas.")
+	flag.BoolVar(&resolveOnce, "resolve-once", false, "Resolve the host of -redis once at startup, and use the address for all connections.")
+	flag.BoolVar(&strict, "strict", false, "Exit nonzero if the lock had expired before the command exited.")
+	flag.BoolVar(&verifyRelease, "verify-release", false, "Verify the lock was actually deleted on release, and exit nonzero if not.")
+	flag.BoolVar(&noStdin, "no-stdin", false, "Give /dev/null to the command's stdin, instead of passing our stdin.")
+	flag.StringVar(&stdinLine, "stdin-line", "", "Write the text and a newline to the command's stdin and close it, instead of passing our stdin.")
+	flag.StringVar(&statsd, "statsd", "", "statsd host:port to send the metrics of locking to.")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", DefaultStatsdPrefix, "Prefix of the metric names sent to -statsd.")
+	flag.BoolVar(&skipIfLocked, "skip-if-locked", false, "If KEY is locked, skip running the command and exit zero, logging it was skipped even with -q and writing \"skipped\" to -result-file. Implies -n.")
+	flag.StringVar(&onLocked, "on-locked", "", "Program to run with KEY as the argument when KEY is locked by another process and go-redis-setlock gives up.")
+	flag.BoolVar(&takeoverDeadHolder, "takeover-dead-holder", false, "Take over the lock of KEY held by a process of this host which does not exist any more. The holders on the other hosts are never taken over.")
+	flag.BoolVar(&tokenIncludeVersion, "token-include-version", false, "Also store the version and the build commit of go-redis-setlock in the lock, shown by -who.")
+	flag.StringVar(&fencingKey, "fencing-key", "", "Counter key to INCR on each acquisition. The value is exported to the command as SETLOCK_FENCE and SETLOCK_FENCING_TOKEN.")
+	flag.BoolVar(&fencing, "fencing", false, "Same as -fencing-key KEY:fence.")
+	flag.IntVar(&fencingFD, "fencing-fd", -1, "File descriptor (3 or larger) of the command to read the fencing token of -fencing or -fencing-key from.")
+	flag.StringVar(&onAmbiguousReply, "on-ambiguous-reply", "fail", "fail or retry, when SET replies neither OK nor nil.")
+	flag.StringVar(&waitKeyAbsent, "wait-key-absent", "", "Wait until the key does not exist before locking. With -n, exits 112 if it exists.")
+	flag.BoolVar(&wrapOutputJSON, "wrap-output-json", false, "Write each line of the command's stdout and stderr to stdout as a JSON object.")
+	flag.IntVar(&maxRuns, "max-runs", 0, "Run the command at most the times within -window. Otherwise exits 113.")
+	flag.DurationVar(&window, "window", time.Hour, "Window of -max-runs.")
+	flag.StringVar(&redisMaster, "redis-master", "", "Same as -redis. Locks are always written to it.")
+	flag.Var(&replicas, "redis-replica", "redis-server host:port of a replica to send read only commands (-lock-check) to. Can be repeated.")
+	flag.DurationVar(&commandTimeout, "command-timeout", 0, "Send SIGTERM to the command when it runs longer than the duration, and SIGKILL after -kill-timeout (10s if 0) more.")
+	flag.IntVar(&timeoutExitCode, "timeout-exit-code", DefaultTimeoutCode, "Exit code when the command was stopped by -command-timeout.")
+	flag.BoolVar(&ttlFromTimeout, "ttl-from-timeout", false, "Expire the lock after -command-timeout, the time to kill the command and -ttl-margin, instead of -expires.")
+	flag.DurationVar(&ttlMargin, "ttl-margin", DefaultTTLMargin, "The margin of -ttl-from-timeout.")
+	flag.StringVar(&emitLossEvent, "emit-loss-event", "", "Append a JSON line to the file (- for stderr) when the lock was found lost while the command ran.")
+	flag.StringVar(&signalOnLoss, "signal-on-loss", "", "Send the signal (HUP, INT, TERM or QUIT) to the command when -refresh found the lock lost.")
+	flag.DurationVar(&killTimeout, "kill-timeout", 0, "Send SIGKILL to the command when it does not exit within the duration after a signal was forwarded. 0 never.")
+	flag.DurationVar(&interruptGrace, "interrupt-grace", 0, "-kill-timeout for SIGINT. 0 is the same as -kill-timeout.")
+	flag.StringVar(&logOn, "log-on", "failure", "When to log the summary line of a run: success, failure, always or never.")
+	flag.StringVar(&acquireCommand, "acquire-command", "", "Shell command to acquire the lock instead of Redis. Exit zero means acquired.")
+	flag.StringVar(&releaseCommand, "release-command", "", "Shell command to release the lock acquired by -acquire-command.")
+	flag.BoolVar(&cluster, "cluster", false, "Follow MOVED and ASK redirects of Redis Cluster.")
+	flag.BoolVar(&sentinel, "sentinel", false, "-redis is comma separated host:port of Redis Sentinels, which are asked for the address of the master -master-name.")
+	flag.StringVar(&masterName, "master-name", "", "Name of the master monitored by -sentinel.")
+	flag.BoolVar(&skipVersionCheck, "skip-version-check", false, "Do not check the version in INFO of the redis-server, for Redis compatible servers which report it differently.")
+	flag.StringVar(&auditStream, "audit-stream", "", "Redis Stream to XADD a record to on each acquisition and release.")
+	flag.IntVar(&auditMaxLen, "audit-maxlen", DefaultAuditMaxLen, "Trim -audit-stream to about the number of records. 0 means no limit.")
+	flag.BoolVar(&showVersion, "version", false, fmt.Sprintf("version %s", Version))
+	flag.Parse()
+	setFlagsFromEnv()
+
+	if showVersion {
+		fmt.Fprintf(os.Stderr, "version: %s\n", Version)
+		os.Exit(0)
+	}
+
+	opt = &Options{
+		Redis:    redis,
+		Password: password,
+		DB:       db,
+		Keep:     keep,
+		Wait:     true,
+		ExitCode: ExitCodeError,
+		Expires:  expires,
+		Slots:    slots,
+
+		WaitTimeout: waitTimeout,
+
+		ExitCodeFile: exitCodeFile,
+		TCPNoDelay:   tcpNoDelay,
+
+		MaxAcquireLatency: maxAcquireLatency,
+		ReleaseDelay:      releaseDelay,
+
+		RequireSuccess:       requireSuccess,
+		RequireSuccessMaxAge: requireSuccessMaxAge,
+		SetSuccess:           setSuccess,
+
+		GC:        gc,
+		Prefix:    prefix,
+		OlderThan: olderThan,
+		Yes:       yes && !dryRun,
+
+		CleanupTimeout: cleanupTimeout,
+
+		Watch:         watch,
+		WatchInterval: watchInterval,
+		WatchBackoff:  watchBackoff,
+		MaxRestarts:   maxRestarts,
+
+		LogFD: logFD,
+
+		LockCheck: lockCheck,
+		Who:       who,
+		Check:     check,
+
+		Release: release,
+		Token:   token,
+		Force:   force,
+		DryRun:  dryRun,
+
+		RequireTTL:       requireTTL,
+		RequireTTLExtend: requireTTLExtend,
+
+		ReadyFD: readyFD,
+
+		ConnectBackoffMax: connectBackoffMax,
+		ConnectTimeout:    connectTimeout,
+
+		SelfTest: selfTest,
+
+		PreRelease:              preRelease,
+		KeepOnPreReleaseFailure: keepOnPreReleaseFailure,
+
+		WaitReplicas:        waitReplicas,
+		WaitReplicasTimeout: waitReplicasTimeout,
+
+		ResolveOnce: resolveOnce,
+
+		VerifyRelease: verifyRelease,
+		Strict:        strict,
+
+		StdinLine: stdinLine,
+		NoStdin:   noStdin,
+
+		Statsd:       statsd,
+		StatsdPrefix: statsdPrefix,
+
+		SkipIfLocked: skipIfLocked,
+		OnLocked:     onLocked,
+
+		FencingKey: fencingKey,
+		Fencing:    fencing,
+		FencingFD:  fencingFD,
+
+		OnAmbiguousReply: onAmbiguousReply,
+
+		WaitKeyAbsent: waitKeyAbsent,
+
+		WrapOutputJSON: wrapOutputJSON,
+
+		MaxRuns: maxRuns,
+		Window:  window,
+
+		Replicas: replicas,
+
+		KillTimeout:    killTimeout,
+		InterruptGrace: interruptGrace,
+
+		LogOn: logOn,
+
+		AcquireCommand: acquireCommand,
+		ReleaseCommand: releaseCommand,
+
+		Cluster: cluster,
+
+		Sentinel:   sentinel,
+		MasterName: masterName,
+
+		SkipVersionCheck: skipVersionCheck,
+
+		AuditStream: auditStream,
+		AuditMaxLen: auditMaxLen,
+
+		Refresh: refresh,
+
+		Shared: shared,
+
+		CommandTimeout:  commandTimeout,
+		TimeoutExitCode: timeoutExitCode,
+
+		TakeoverDeadHolder: takeoverDeadHolder,
+
+		TokenIncludeVersion: tokenIncludeVersion,
+
+		EmitLossEvent: emitLossEvent,
+
+		ResultFile: resultFile,
+	}
+	if keys != "" {
+		opt.Keys = parseKeys(keys)
+		for i := range opt.Keys {
+			opt.Keys[i] = opt.Prefix + opt.Keys[i]
+		}
+		if opt.Slots > 0 {
+			usageError("-keys and -slots can not be used together")
+		}
+		if opt.AcquireCommand != "" {
+			usageError("-keys and -acquire-command can not be used together")
+		}
+	}
+	if opt.Shared {
+		if names := sharedOptionConflicts(opt); names != "" {
+			usageError("-shared can not be used with %s", names)
+		}
+	}
+	if opt.NoStdin && opt.StdinLine != "" {
+		usageError("-no-stdin and -stdin-line can not be used together")
+	}
+	if redisMaster != "" {
+		opt.Redis = redisMaster
+	}
+	if opt.Sentinel {
+		if opt.MasterName == "" {
+			usageError("-sentinel requires -master-name")
+		}
+		if opt.Cluster {
+			usageError("-sentinel and -cluster can not be used together")
+		}
+	} else if strings.HasPrefix(opt.Redis, "unix://") {
+		opt.Redis = strings.TrimPrefix(opt.Redis, "unix://")
+		if !isUnixSocket(opt.Redis) {
+			usageError("invalid -redis: unix:// requires an absolute path")
+		}
+	} else if isRedisURL(opt.Redis) {
+		u, err := parseRedisURL(opt.Redis)
+		if err != nil {
+			usageError("invalid -redis: %s", err)
+		}
+		addSecret(u.Password) // even when overridden by -auth
+		opt.Redis = u.Addr
+		opt.Username = u.Username
+		if opt.Password == "" {
+			opt.Password = u.Password
+		}
+		if opt.DB == 0 {
+			opt.DB = u.DB
+		}
+		if u.TLS {
+			useTLS = true
+		}
+	}
+	if useTLS {
+		cfg, err := newTLSConfig(tlsCA, tlsCert, tlsKey, tlsSkipVerify)
+		if err != nil {
+			usageError("invalid -tls options: %s", err)
+		}
+		opt.TLSConfig = cfg
+	}
+	if opt.Password == "" {
+		opt.Password = os.Getenv("REDIS_PASSWORD")
+	}
+	addSecret(opt.Password)
+	addSecret(os.Getenv("REDIS_PASSWORD")) // even when overridden by -auth
+	if noDelay || skipIfLocked {
+		opt.Wait = false
+	}
+	logOutput := io.Writer(os.Stderr)
+	if logFD != 2 {
+		f := os.NewFile(uintptr(logFD), fmt.Sprintf("fd%d", logFD))
+		if _, err := f.Stat(); err != nil {
+			usageError("invalid -log-fd: %s", err)
+		}
+		// never leak the log fd to the command
+		syscall.CloseOnExec(logFD)
+		logOutput = f
+	}
+	var logWriter io.Writer
+	switch logFormat {
+	case "text":
+		logWriter = redactWriter{logOutput}
+	case "json":
+		jsonLog = &jsonLogWriter{w: redactWriter{logOutput}}
+		log.SetFlags(0)
+		logWriter = jsonLog
+	default:
+		usageError("invalid -log-format: %s (text or json)", logFormat)
+	}
+	switch {
+	case verbose && quiet:
+		usageError("-v and -q can not be used together")
+	case verbose:
+		logLevel = LogVerbose
+	case quiet:
+		logLevel = LogQuiet
+		errorLog = log.New(logWriter, "", log.Flags())
+		logWriter = ioutil.Discard
+	}
+	log.SetOutput(logWriter)
+	switch logOn {
+	case "success", "failure", "always", "never":
+	default:
+		usageError("invalid -log-on: %s (success, failure, always or never)", logOn)
+	}
+	if onAmbiguousReply != "fail" && onAmbiguousReply != "retry" {
+		usageError("invalid -on-ambiguous-reply: %s (fail or retry)", onAmbiguousReply)
+	}
+	if readyPattern != "" {
+		re, err := regexp.Compile(readyPattern)
+		if err != nil {
+			usageError("invalid -ready-pattern: %s", err)
+		}
+		opt.ReadyPattern = re
+	}
+	if opt.WatchInterval < 0 {
+		usageError("invalid -watch-interval: %s", opt.WatchInterval)
+	}
+	if opt.WatchBackoff < 0 {
+		usageError("invalid -watch-backoff-max: %s", opt.WatchBackoff)
+	}
+	if opt.ConnectBackoffMax <= 0 {
+		usageError("invalid -connect-backoff-max: %s (must be positive)", opt.ConnectBackoffMax)
+	}
+	if opt.MaxRestarts < 0 {
+		usageError("invalid -max-restarts: %d", opt.MaxRestarts)
+	}
+	if opt.Fencing && opt.FencingKey != "" {
+		usageError("-fencing and -fencing-key can not be used together")
+	}
+	if fencingFD >= 0 {
+		if !opt.Fencing && opt.FencingKey == "" {
+			usageError("-fencing-fd requires -fencing or -fencing-key")
+		}
+		if fencingFD < 3 {
+			usageError("invalid -fencing-fd: %d (3 or larger)", fencingFD)
+		}
+	}
+	if readyFD >= 0 {
+		syscall.CloseOnExec(readyFD)
+	}
+	if localAddr != "" {
+		ip := net.ParseIP(localAddr)
+		if ip == nil {
+			usageError("invalid -local-addr: %s is not an IP address", localAddr)
+		}
+		if isUnixSocket(opt.Redis) {
+			usageError("-local-addr can not be used with a Unix domain socket")
+		}
+		opt.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if exitZero {
+		opt.ExitCode = 0
+	}
+	if signalOnLoss != "" {
+		sig, err := parseTrapSignal(signalOnLoss)
+		if err != nil {
+			usageError("invalid -signal-on-loss: %s", err)
+		}
+		if !opt.Refresh {
+			usageError("-signal-on-loss requires -refresh")
+		}
+		opt.SignalOnLoss = sig
+	}
+	if ttlFromTimeout {
+		if opt.CommandTimeout <= 0 {
+			usageError("-ttl-from-timeout requires -command-timeout")
+		}
+		if flagGiven("expires") {
+			usageError("-ttl-from-timeout and -expires can not be used together")
+		}
+		if ttlMargin < 0 {
+			usageError("invalid -ttl-margin: %s", ttlMargin)
+		}
+		opt.Expires = timeoutTTL(opt, ttlMargin)
+	}
+
+	modes := 0
+	for _, m := range []bool{opt.SelfTest, opt.GC, opt.LockCheck, opt.Who, opt.Check, opt.Release} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		usageError("-selftest, -gc, -lock-check, -who, -check and -release can not be used together")
+	}
+	if opt.Release && opt.Token == "" && !opt.Force {
+		usageError("-release requires -token or -force")
+	}
+	if opt.Token != "" && opt.Force {
+		usageError("-token and -force can not be used together")
+	}
+
+	remainArgs := flag.Args()
+	switch {
+	case opt.SelfTest:
+		if len(remainArgs) > 0 {
+			usageError("-selftest takes no arguments: %s", strings.Join(remainArgs, " "))
+		}
+		return opt, "", "", nil
+	case opt.GC:
+		if opt.Prefix == "" {
+			usageError("-gc requires -prefix")
+		}
+		if opt.OlderThan <= 0 {
+			usageError("-gc requires -older-than")
+		}
+		if len(remainArgs) > 0 {
+			usageError("-gc takes no arguments: %s", strings.Join(remainArgs, " "))
+		}
+		return opt, "", "", nil
+	case opt.LockCheck, opt.Who, opt.Check, opt.Release:
+		if len(remainArgs) == 0 {
+			usageError("missing KEY")
+		}
+		if len(remainArgs) > 1 {
+			mode := "-lock-check"
+			if opt.Who {
+				mode = "-who"
+			} else if opt.Check {
+				mode = "-check"
+			} else if opt.Release {
+				mode = "-release"
+			}
+			usageError("%s takes only KEY: %s", mode, strings.Join(remainArgs[1:], " "))
+		}
+		return opt, opt.Prefix + remainArgs[0], "", nil
+	}
+
+	if len(opt.Keys) > 0 {
+		// all the keys are given by -keys, so KEY is omitted.
+		remainArgs = append([]string{strings.Join(opt.Keys, ",")}, remainArgs...)
+	}
+	switch len(remainArgs) {
+	case 0:
+		usageError("missing KEY")
+	case 1:
+		usageError("missing program after KEY")
+	}
+	key = remainArgs[0]
+	if len(opt.Keys) == 0 {
+		key = opt.Prefix + key
+	}
+	program = remainArgs[1]
+	if len(remainArgs) >= 3 {
+		args = remainArgs[2:]
+	}
+
+	return opt, key, program, args
+}
+
+// usageError reports the malformed invocation and exits usageExitCode().
+func usageError(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "go-redis-setlock: %s\n", redact(fmt.Sprintf(format, a...)))
+	fmt.Fprintf(os.Stderr, "Run go-redis-setlock -h for usage.\n")
+	os.Exit(usageExitCode())
+}
+
+// usageExitCode is ExitCodeUsage, except with -lock-check (as parsed so
+// far), whose exit codes 0..LockCheckNoTTL tell the TTL: it fails only with
+// ExitCodeError, so that an error is never taken for a TTL.
+func usageExitCode() int {
+	if f := flag.Lookup("lock-check"); f != nil && f.Value.String() == "true" {
+		return ExitCodeError
+	}
+	return ExitCodeUsage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n    go-redis-setlock [-nNxX] KEY program [ arg ... ]\n    go-redis-setlock [-nNxX] -keys KEY,KEY,... program [ arg ... ]\n    go-redis-setlock -gc -prefix PREFIX -older-than DURATION [-yes]\n    go-redis-setlock -lock-check KEY\n    go-redis-setlock -who KEY\n    go-redis-setlock [-xX] -check KEY\n    go-redis-setlock -release (-token TOKEN | -force) [-dry-run] KEY\n    go-redis-setlock -selftest\n\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nEach option (except the one letter ones, and the modes and their confirmations such as -gc, -release,\n-watch, -yes and -force) can also be given by an environment variable: %s followed by its name in upper\ncase with - replaced by _ (e.g. %s for -wait-timeout). %s=false is -n, and true is -N.\nPrecedence: the options on the command line, then the environment variables, then the defaults.\n", EnvPrefix, envName("wait-timeout"), EnvWait)
+	os.Exit(usageExitCode())
+}
+
+func run(opt *Options, key string, program string, args []string) int {
+	ctx, stop := signalContext()
+	c, err := connectToRedisServer(ctx, opt)
+	if s := stop(); s != nil {
+		if err == nil {
+			c.Close()
+		}
+		logEvent("warn", "", nil, "Got signal: %s. gave up connecting to the redis-server", s)
+		return signalExitCode(s)
+	}
+	if err != nil {
+		logEvent("error", key, err, "Redis server seems down")
+		return ExitCodeError
+	}
+	defer c.Close()
+
+	if opt.SkipVersionCheck {
+		log.Println("warning: the version of the redis-server is not verified (-skip-version-check)")
+	} else if !validateRedisVersion(c) {
+		return ExitCodeError
+	}
+	if opt.Watch {
+		return watch(c, opt, key, program, args)
+	}
+	code, _, _ := runLocked(c, opt, key, program, args)
+	return code
+}
+
+// runLocked invokes the program holding the lock of key. sig is the signal
+// forwarded to the program, if any, and elapsed is how long the program ran
+// (zero if it was not run).
+func runLocked(c *RedisConn, opt *Options, key string, program string, args []string) (code int, sig os.Signal, elapsed time.Duration) {
+	ctx, stopTrap := signalContext()
+	defer func() {
+		// a signal received after the program exited, e.g. while waiting
+		// for the cleanup, still ends -watch.
+		if s := stopTrap(); sig == nil {
+			sig = s
+		}
+	}()
+	skipped, ran = false, false
+	if opt.RequireSuccess != "" {
+		if err := checkSuccessMarker(c, opt.RequireSuccess, opt.RequireSuccessMaxAge); err != nil {
+			logError(opt.RequireSuccess, err)
+			return ExitCodeNotMet, nil, 0
+		}
+	}
+	if opt.WaitKeyAbsent != "" {
+		if err := waitForKeyAbsent(ctx, c, opt, opt.WaitKeyAbsent); err != nil {
+			if s := stopTrap(); s != nil {
+				log.Printf("Got signal: %s. gave up waiting for %s\n", s, opt.WaitKeyAbsent)
+				return signalExitCode(s), s, 0
+			}
+			logError(opt.WaitKeyAbsent, err)
+			return ExitCodeNotMet, nil, 0
+		}
+	}
+	keys := lockKeys(opt, key)
+	start := time.Now()
+	var slot int
+	var token string
+	var err error
+	var held []string // the keys locked
+	if len(opt.Keys) > 0 {
+		token, err = tryGetLocks(ctx, c, opt, keys)
+		held = keys
+	} else if opt.Shared {
+		token, err = tryGetSharedLock(ctx, c, opt, key)
+		if err == nil {
+			held = keys
+		}
+	} else {
+		slot, token, err = tryGetLock(ctx, c, opt, keys)
+		if err == nil {
+			held = keys[slot : slot+1]
+		}
+	}
+	if s := stopTrap(); s != nil {
+		if err == nil {
+			rollbackLocks(c, opt, key, held, token)
+		}
+		logSummary(opt, "warn", false, "%s: got signal %s while waiting for the lock", key, s)
+		return signalExitCode(s), s, 0
+	}
+	name := strings.Join(held, ",")
+	stats.Timing("wait_ms", time.Now().Sub(start))
+	if err == setlock.ErrLocked && opt.OnLocked != "" {
+		runOnLocked(c, opt, key, keys)
+	}
+	if err == setlock.ErrLocked && opt.SkipIfLocked {
+		logEvent("notice", key, nil, "skipped: %s is already locked by another process", key)
+		stats.Incr("skipped")
+		skipped = true
+		return 0, nil, 0
+	}
+	if err == nil {
+		stats.Incr("acquired")
+		lockAcquired()
+	} else {
+		stats.Incr("failed")
+	}
+	if err == nil && opt.RequireTTL > 0 {
+		if err := ensureTTLs(c, opt, held, token); err != nil {
+			logError(name, err)
+			rollbackLocks(c, opt, key, held, token)
+			return ExitCodeNotMet, nil, 0
+		}
+	}
+	if err == nil && opt.MaxRuns > 0 {
+		if err := countRun(c, opt, key); err != nil {
+			logError(key, err)
+			rollbackLocks(c, opt, key, held, token)
+			return ExitCodeTooMany, nil, 0
+		}
+	}
+	if err == nil {
+		var env []string
+		if opt.Slots > 0 {
+			env = append(env, fmt.Sprintf("SETLOCK_SLOT=%d", slot))
+		}
+		var files []*os.File
+		if fencing := fencingKey(opt, key); fencing != "" {
+			fence, err := c.Cmd("INCR", fencing).Int64()
+			if err != nil {
+				logEvent("error", fencing, err, "could not INCR fencing key %s", fencing)
+				rollbackLocks(c, opt, key, held, token)
+				return ExitCodeError, nil, 0
+			}
+			env = append(env,
+				fmt.Sprintf("SETLOCK_FENCE=%d", fence),
+				fmt.Sprintf("SETLOCK_FENCING_TOKEN=%d", fence),
+			)
+			if opt.FencingFD >= 0 {
+				if files, err = fencingFiles(opt.FencingFD, fence); err != nil {
+					logError(fencing, err)
+					rollbackLocks(c, opt, key, held, token)
+					return ExitCodeError, nil, 0
+				}
+			}
+		}
+		writeAudit(c, opt, name, token, "acquire", -1)
+		start = time.Now()
+		ran = true
+		if opt.Refresh {
+			stop := startRefresh(c, opt, held, token)
+			code, sig = invokeCommand(opt, program, args, env, files)
+			stop()
+		} else {
+			code, sig = invokeCommand(opt, program, args, env, files)
+		}
+		elapsed = time.Now().Sub(start)
+		stats.Timing("run_ms", elapsed)
+		stats.Gauge("exit_code", code)
+		keep := opt.Keep
+		if opt.PreRelease != "" {
+			env = append(env, fmt.Sprintf("SETLOCK_EXIT_CODE=%d", code))
+			if err := runHook(opt.PreRelease, env); err != nil {
+				log.Printf("-pre-release command failed: %s\n", err)
+				if opt.KeepOnPreReleaseFailure {
+					keep = true
+				}
+			}
+		}
+		if code == 0 && opt.SetSuccess != "" {
+			runCleanup(c, "setting the success marker", opt.CleanupTimeout, func(c *RedisConn) error {
+				return setSuccessMarker(c, opt.SetSuccess)
+			})
+		}
+		if keep {
+			writeAudit(c, opt, name, token, "keep", code)
+			logSummary(opt, "info", code == 0, "%s: locked, exit code %d, lock kept", name, code)
+			return code, sig, elapsed
+		}
+		if opt.ReleaseDelay > 0 {
+			delayRelease(opt.ReleaseDelay)
+		}
+		err := runCleanup(c, "releasing the lock", opt.CleanupTimeout, func(c *RedisConn) error {
+			return releaseLocks(c, opt, held, token)
+		})
+		if err == nil {
+			logEvent("debug", name, nil, "released lock %s", name)
+		} else if (opt.VerifyRelease || opt.Strict) && code == 0 {
+			code = ExitCodeError
+		}
+		writeAudit(c, opt, name, token, "release", code)
+		logSummary(opt, "info", code == 0, "%s: locked, exit code %d, lock released", name, code)
+		return code, sig, elapsed
+	} else if err == setlock.ErrLocked {
+		logSummary(opt, lockFailureLevel(opt), false, "%s: %s", key, err)
+		return opt.ExitCode, nil, 0
+	} else {
+		// not locked by another, so not zero by -x.
+		logEvent("error", key, err, "could not lock %s", key)
+		return ExitCodeError, nil, 0
+	}
+}
+
+// logSummary logs the summary line of a run at level by -log-on. A run
+// succeeded when the lock was acquired and the program exited zero.
+func logSummary(opt *Options, level string, succeeded bool, format string, a ...interface{}) {
+	switch opt.LogOn {
+	case "never":
+		return
+	case "success":
+		if !succeeded {
+			return
+		}
+	case "failure":
+		if succeeded {
+			return
+		}
+	}
+	logEvent(level, "", nil, format, a...)
+}
+
+// lockFailureLevel is the level of the summary when the lock was not
+// acquired. It is not an error with -x, which exits zero.
+func lockFailureLevel(opt *Options) string {
+	if opt.ExitCode == 0 {
+		return "info"
+	}
+	return "error"
+}
+
+// watch invokes the program each time it gets the lock, pausing
+// opt.WatchInterval between the runs, until a signal is received.
+// It returns the exit code of the last run.
+//
+// When the program exits nonzero within CrashLoopWindow, the pause is doubled
+// up to opt.WatchBackoff, and watch gives up after opt.MaxRestarts such runs
+// in a row. A run which lasts longer or succeeds resets the pause.
+//
+// The connection dropped by a cleanup which timed out (see runCleanup) is
+// re-established before the next run.
+func watch(c *RedisConn, opt *Options, key string, program string, args []string) int {
+	signalCh := make(chan os.Signal, 1)
+	interval := opt.WatchInterval
+	crashes := 0
+	for {
+		if c.dropped {
+			if err := c.Reconnect(); err != nil {
+				logEvent("error", "", err, "Redis server seems down")
+				return ExitCodeError
+			}
+		}
+		code, sig, elapsed := runLocked(c, opt, key, program, args)
+		if sig != nil {
+			return code
+		}
+		if elapsed > 0 && code != 0 && elapsed < CrashLoopWindow {
+			crashes++
+			if opt.MaxRestarts > 0 && crashes > opt.MaxRestarts {
+				log.Printf("command failed %d times in a row after %d restarts, giving up -watch\n", crashes, opt.MaxRestarts)
+				return code
+			}
+			if crashes > 1 && interval < opt.WatchBackoff {
+				interval *= 2
+				if interval < RetryInterval {
+					interval = RetryInterval // doubling 0 would never back off
+				}
+				if interval > opt.WatchBackoff {
+					interval = opt.WatchBackoff
+				}
+				log.Printf("command failed %d times in a row, backing off to %s\n", crashes, interval)
+			}
+		} else if elapsed > 0 {
+			if crashes > 1 {
+				log.Printf("command recovered, pause reset to %s\n", opt.WatchInterval)
+			}
+			crashes = 0
+			interval = opt.WatchInterval
+		}
+		signal.Notify(signalCh, TrapSignals...)
+		select {
+		case <-time.After(interval):
+		case s := <-signalCh:
+			log.Printf("Got signal: %s. exiting from -watch", s)
+			return code
+		}
+		signal.Stop(signalCh)
+	}
+}
+
+// connectToRedisServer connects to the redis-server, giving up an attempt
+// after opt.ConnectTimeout. With -N it retries until -wait-timeout (or
+// -expires), and with -n it gives up after the first attempt.
+func connectToRedisServer(ctx context.Context, opt *Options) (c *RedisConn, err error) {
+	timeout := 0
+	if opt.Wait {
+		timeout = opt.Expires
+		if opt.WaitTimeout > 0 {
+			timeout = int((opt.WaitTimeout + time.Second - 1) / time.Second)
+		}
+	}
+	start := time.Now()
+	backoff := RetryInterval
+	for {
+		c, err = dialRedis(opt)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(*SetupError); ok {
+			break
+		}
+		end := time.Now()
+		elapsed := int(end.Sub(start) / time.Millisecond) // msec
+		if elapsed >= timeout*1000 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		backoff *= 2
+		if backoff > opt.ConnectBackoffMax {
+			backoff = opt.ConnectBackoffMax
+		}
+	}
+	return c, err
+}
+
+// jitter returns a random duration between d/2 and d, so that clients
+// waiting for a restarting redis-server do not reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d < 2 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// connectForProbe connects to the redis-server for the modes which only
+// look at the lock (-check, -who, -release, -lock-check and -gc). Unlike
+// locking it does not wait for the redis-server for -expires, but tries
+// once, or until -wait-timeout when given.
+func connectForProbe(opt *Options) (*RedisConn, error) {
+	o := *opt
+	o.Wait = opt.Wait && opt.WaitTimeout > 0
+	return connectToRedisServer(context.Background(), &o)
+}
+
+// connectToReplica connects to a randomly chosen -redis-replica for read only
+// commands, or to the master when no replica is given or it is down, as
+// connectForProbe. Commands which write must never use this.
+func connectToReplica(opt *Options) (*RedisConn, error) {
+	if len(opt.Replicas) == 0 {
+		return connectForProbe(opt)
+	}
+	o := *opt
+	o.Redis = opt.Replicas[rand.Intn(len(opt.Replicas))]
+	o.Wait = false
+	c, err := connectToRedisServer(context.Background(), &o)
+	if err == nil {
+		return c, nil
+	}
+	log.Printf("replica %s seems down: %s. using the master\n", o.Redis, err)
+	return connectForProbe(opt)
+}
+
+// pinRedisAddr replaces the host of opt.Redis with its resolved IP address,
+// so that reconnections during the session never reach another server.
+func pinRedisAddr(opt *Options) error {
+	if isUnixSocket(opt.Redis) || opt.Sentinel {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(opt.Redis)
+	if err != nil {
+		return fmt.Errorf("invalid -redis %s: %s", opt.Redis, err)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %s", host, err)
+	}
+	if opt.TLSConfig != nil && opt.TLSConfig.ServerName == "" {
+		opt.TLSConfig.ServerName = host // verify the certificate by the name
+	}
+	opt.Redis = net.JoinHostPort(addrs[0], port)
+	return nil
+}
+
+// isUnixSocket reports whether addr is the path of a Unix domain socket
+// rather than host:port.
+func isUnixSocket(addr string) bool {
+	return strings.HasPrefix(addr, "/")
+}
+
+// dialRedis opens a connection to the redis-server through a net.Dialer
+// configured by opt.
+func dialRedis(opt *Options) (*RedisConn, error) {
+	timeout := opt.ConnectTimeout
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: opt.LocalAddr,
+	}
+	addr := opt.Redis
+	if opt.Sentinel {
+		// resolved on each connection, to follow failovers.
+		var err error
+		if addr, err = resolveMaster(opt, timeout); err != nil {
+			return nil, err
+		}
+	}
+	network := "tcp"
+	if isUnixSocket(addr) {
+		network = "unix"
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		if opt.LocalAddr != nil {
+			return nil, fmt.Errorf("dial from local address %s: %s", opt.LocalAddr, err)
+		}
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		// The commands are small request/response round trips, which
+		// Nagle's algorithm would only delay.
+		tc.SetNoDelay(opt.TCPNoDelay)
+	}
+	if opt.TLSConfig != nil {
+		tc, err := tlsHandshake(conn, addr, opt.TLSConfig, timeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	client, err := redis.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if timeout > 0 {
+		// a server which accepted but never responds.
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := setupConn(client, opt); err != nil {
+		client.Close()
+		return nil, &SetupError{err}
+	}
+	conn.SetDeadline(time.Time{})
+	c := &RedisConn{Client: client, conn: conn, opt: opt}
+	if opt.Cluster {
+		c.cluster = newClusterState()
+	}
+	return c, nil
+}
+
+// setupConn prepares a new connection before any other command is sent.
+func setupConn(client *redis.Client, opt *Options) error {
+	if opt.Password != "" {
+		args := []interface{}{opt.Password}
+		if opt.Username != "" {
+			args = []interface{}{opt.Username, opt.Password}
+		}
+		if r := client.Cmd("AUTH", args...); r.Err != nil {
+			return fmt.Errorf("AUTH failed: %s", r.Err)
+		}
+	}
+	if opt.DB != 0 {
+		if r := client.Cmd("SELECT", opt.DB); r.Err != nil {
+			return fmt.Errorf("SELECT %d failed: %s", opt.DB, r.Err)
+		}
+	}
+	return nil
+}
+
+// CmdWithin issues the command with a deadline of d (no deadline if d is
+// zero). timedOut reports whether the deadline was exceeded, in which case
+// the connection must be re-established before use.
+func (c *RedisConn) CmdWithin(d time.Duration, cmd string, args ...interface{}) (r *redis.Reply, timedOut bool) {
+	if d <= 0 || c.dropped {
+		return c.Cmd(cmd, args...), false
+	}
+	start := time.Now()
+	c.conn.SetDeadline(start.Add(d))
+	r = c.Cmd(cmd, args...)
+	c.conn.SetDeadline(time.Time{})
+	return r, r.Err != nil && time.Now().Sub(start) >= d
+}
+
+// Reconnect closes the connection and connects to the redis-server again.
+func (c *RedisConn) Reconnect() error {
+	c.Close()
+	nc, err := connectToRedisServer(context.Background(), c.opt)
+	if err != nil {
+		return err
+	}
+	*c = *nc
+	return nil
+}
+
+// parseVersion parses "major.minor.rev" leniently. A missing or non numeric
+// component (e.g. "7", "6.2.5-compat") counts as 0 or up to its first
+// non digit.
+func parseVersion(version string) (major, minor, rev int) {
+	var n [3]int
+	for i, s := range strings.SplitN(strings.TrimSpace(version), ".", 3) {
+		end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || '9' < r })
+		if end >= 0 {
+			s = s[:end]
+		}
+		n[i], _ = strconv.Atoi(s)
+	}
+	return n[0], n[1], n[2]
+}
+
+func validateRedisVersion(c *RedisConn) bool {
+	version := ""
+
+	r := c.Cmd("info")
+	info, _ := r.Str()
+	for _, line := range strings.Split(info, "\n") {
+		pair := strings.SplitN(line, ":", 2)
+		if pair[0] == "redis_version" {
+			version = pair[1]
+			break
+		}
+	}
+	if version == "" {
+		logEvent("error", "", nil, "could not detect Redis server version from INFO outout. %s", info)
+		return false
+	}
+
+	major, minor, rev := parseVersion(version)
+	if (major >= 3) || (major == 2 && minor >= 7) || (major == 2 && minor == 6 && rev >= 12) {
+		return true
+	}
+	logEvent("error", "", nil, "required Redis server version >= 2.6.12. current server version is %s", version)
+	return false
+}
+
+// runLockCheck returns the remaining TTL seconds of key as an exit code.
+// It is 0 when key is not locked, MaxLockCheckTTL when the TTL is
+// MaxLockCheckTTL seconds or longer, and LockCheckNoTTL when key has no TTL,
+// so that ExitCodeError always means an error.
+func runLockCheck(opt *Options, key string) int {
+	c, err := connectToReplica(opt)
+	if err != nil {
+		log.Printf("Redis server seems down: %s\n", err)
+		return ExitCodeError
+	}
+	defer c.Close()
 
-type Options struct {
-	Redis    string
-	Expires  int
-	Keep     bool
-	Wait     bool
-	ExitCode int
+	ttl, err := c.Cmd("TTL", key).Int()
+	if err != nil {
+		log.Printf("could not get TTL of %s: %s\n", key, err)
+		return ExitCodeError
+	}
+	switch {
+	case ttl == -2: // not exists
+		return 0
+	case ttl == -1: // no TTL
+		return LockCheckNoTTL
+	case ttl > MaxLockCheckTTL:
+		return MaxLockCheckTTL
+	case ttl < 0:
+		return 0
+	}
+	return ttl
 }
 
-func main() {
-	code := run()
-	os.Exit(code)
+// lockKeys returns the candidate keys for KEY. With -slots N they are
+// KEY-0 .. KEY-(N-1), with -keys all the keys to lock, otherwise KEY itself.
+func lockKeys(opt *Options, key string) []string {
+	if len(opt.Keys) > 0 {
+		return opt.Keys
+	}
+	if opt.Slots <= 0 {
+		return []string{key}
+	}
+	keys := make([]string, opt.Slots)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s-%d", key, i)
+	}
+	return keys
 }
 
-func parseOptions() (opt *Options, key string, program string, args []string) {
-	var redis string
-	var expires int
-	var keep bool
-	var noDelay bool
-	var delay bool
-	var exitZero bool
-	var exitNonZero bool
-	var showVersion bool
+// setLock tries to lock key once. A failed attempt, such as a timeout, is
+// logged and reported as not locked.
+func setLock(c *RedisConn, opt *Options, key string, token string) (locked bool, err error) {
+	value := newHolder(opt, token).String()
+	r, timedOut := c.CmdWithin(opt.MaxAcquireLatency, "SET", key, value, "EX", opt.Expires, "NX")
+	if timedOut {
+		logEvent("warn", key, nil, "SET %s did not respond within %s", key, opt.MaxAcquireLatency)
+		if err := c.Reconnect(); err != nil {
+			return false, err
+		}
+		// the SET may have been applied after all.
+		c.Cmd("EVAL", setlock.UnlockLUAScript, 1, key, token)
+		return false, nil
+	}
+	locked, err = setlock.ParseLockReply(r)
+	if err == setlock.ErrAmbiguousReply {
+		// the SET may have been applied, and would lock out ourselves.
+		c.Cmd("EVAL", setlock.UnlockLUAScript, 1, key, token)
+		if opt.OnAmbiguousReply == "fail" {
+			return false, fmt.Errorf("SET %s: %s %s", key, err, r)
+		}
+		logEvent("warn", key, fmt.Errorf("%s %s", err, r), "SET %s", key)
+		return false, nil
+	} else if err != nil {
+		// e.g. OOM, READONLY or NOAUTH, never taken for locked by another.
+		return false, fmt.Errorf("SET %s: %s", key, err)
+	}
+	if !locked && opt.TakeoverDeadHolder {
+		if locked, err = takeoverDeadHolder(c, opt, key, token); err != nil {
+			logEvent("error", key, err, "could not take over the lock %s", key)
+			return false, nil
+		}
+	}
+	return locked, nil
+}
 
-	flag.Usage = usage
-	flag.StringVar(&redis, "redis", "127.0.0.1:6379", "redis-server host:port")
-	flag.IntVar(&expires, "expires", DefaultExpires, "The lock will be auto-released after the expire time is reached.")
-	flag.BoolVar(&keep, "keep", false, "Keep the lock after invoked command exited.")
-	flag.BoolVar(&noDelay, "n", false, "No delay. If KEY is locked by another process, go-redis-setlock gives up.")
-	flag.BoolVar(&delay, "N", true, "(Default.) Delay. If KEY is locked by another process, go-redis-setlock waits until it can obtain a new lock.")
-	flag.BoolVar(&exitZero, "x", false, "If KEY is locked, go-redis-setlock exits zero.")
-	flag.BoolVar(&exitNonZero, "X", true, "(Default.) If KEY is locked, go-redis-setlock prints an error message and exits nonzero.")
-	flag.BoolVar(&showVersion, "version", false, fmt.Sprintf("version %s", Version))
-	flag.Parse()
+// timeoutTTL returns the TTL in seconds of -ttl-from-timeout: the lock
+// outlives the command by at most margin, even when it is killed after
+// -command-timeout.
+func timeoutTTL(opt *Options, margin time.Duration) int {
+	grace := opt.KillTimeout
+	if grace <= 0 {
+		grace = DefaultTimeoutGrace
+	}
+	d := opt.CommandTimeout + grace + margin
+	return int((d + time.Second - 1) / time.Second)
+}
 
-	if showVersion {
-		fmt.Fprintf(os.Stderr, "version: %s\n", Version)
-		os.Exit(0)
+// tryGetLocks locks all of keys with the same token. The keys are locked in
+// the order given (sorted by parseKeys), so that processes locking
+// overlapping sets never deadlock. When any of them is locked by another,
+// the ones already locked are released before waiting for the next attempt.
+func tryGetLocks(ctx context.Context, c *RedisConn, opt *Options, keys []string) (token string, err error) {
+	token = setlock.NewToken()
+	start := time.Now()
+	attempts, err := setlock.Retry(ctx, retryOptions(opt, strings.Join(keys, ",")), func() (bool, error) {
+		for n, key := range keys {
+			locked, err := setLock(c, opt, key, token)
+			if err != nil || !locked {
+				releaseAll(c, keys[:n], token)
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if opt.WaitReplicas > 0 {
+		if err := waitReplicas(c, opt, keys); err != nil {
+			releaseAll(c, keys, token)
+			return "", err
+		}
 	}
+	name := strings.Join(keys, ",")
+	logEvent("debug", name, nil, "acquired lock %s, attempt %d, waited %s", name, attempts, time.Now().Sub(start).Round(time.Millisecond))
+	return token, nil
+}
 
-	opt = &Options{
-		Redis:    redis,
-		Keep:     keep,
-		Wait:     true,
-		ExitCode: ExitCodeError,
-		Expires:  expires,
+// rollbackLocks releases the locks held just acquired, when the program is
+// not run after all. Unlike releaseLocks it ignores opt.Keep, which keeps
+// the lock of a program which ran.
+func rollbackLocks(c *RedisConn, opt *Options, key string, held []string, token string) {
+	if opt.Shared {
+		releaseSharedLock(c, key, token)
+		return
 	}
-	if noDelay {
-		opt.Wait = false
+	releaseAll(c, held, token)
+}
+
+// releaseAll rolls back the locks of keys acquired by tryGetLocks.
+func releaseAll(c *RedisConn, keys []string, token string) {
+	for _, key := range keys {
+		setlock.NewHandle(c, key, token).Release()
 	}
-	if exitZero {
-		opt.ExitCode = 0
+}
+
+// parseKeys parses the comma separated -keys, returning them sorted
+// without duplicates.
+func parseKeys(s string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	remainArgs := flag.Args()
-	if len(remainArgs) >= 2 {
-		key = remainArgs[0]
-		program = remainArgs[1]
-		if len(remainArgs) >= 3 {
-			args = remainArgs[2:]
+// tryGetLock locks the first available key of keys and returns its index.
+func tryGetLock(ctx context.Context, c *RedisConn, opt *Options, keys []string) (slot int, token string, err error) {
+	token = setlock.NewToken()
+	start := time.Now()
+	name := strings.Join(keys, ",")
+	attempts, err := setlock.Retry(ctx, retryOptions(opt, name), func() (bool, error) {
+		for i, key := range keys {
+			locked, err := setLock(c, opt, key, token)
+			if err != nil || locked {
+				slot = i
+				return locked, err
+			}
 		}
-	} else {
-		usage()
+		return false, nil
+	})
+	if err != nil {
+		return 0, "", err
 	}
+	if opt.WaitReplicas > 0 {
+		if err := waitReplicas(c, opt, keys[slot:slot+1]); err != nil {
+			c.Cmd("EVAL", setlock.UnlockLUAScript, 1, keys[slot], token)
+			return 0, "", err
+		}
+	}
+	logEvent("debug", keys[slot], nil, "acquired lock %s, attempt %d, waited %s", keys[slot], attempts, time.Now().Sub(start).Round(time.Millisecond))
+	return slot, token, nil
+}
 
-	return opt, key, program, args
+// retryOptions returns the options of setlock.Retry by opt, logging each
+// wait for the lock name.
+func retryOptions(opt *Options, name string) setlock.Options {
+	return setlock.Options{
+		Expires:       opt.Expires,
+		Wait:          opt.Wait,
+		RetryInterval: RetryInterval,
+		WaitTimeout:   opt.WaitTimeout,
+		OnWait: func(attempts int, waited time.Duration) {
+			logEvent("debug", name, nil, "waiting for lock %s held by another process, attempt %d, waited %s", name, attempts, waited.Round(time.Millisecond))
+		},
+	}
 }
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "usage:\n    go-redis-setlock [-nNxX] KEY program [ arg ... ]\n\n")
-	flag.PrintDefaults()
-	os.Exit(2)
+// waitReplicas blocks until the preceding writes on keys are acknowledged
+// by opt.WaitReplicas replicas, or fails after opt.WaitReplicasTimeout.
+// With -cluster WAIT goes to each node which served the writes.
+func waitReplicas(c *RedisConn, opt *Options, keys []string) error {
+	timeout := int64(opt.WaitReplicasTimeout / time.Millisecond)
+	if timeout <= 0 {
+		timeout = 1 // WAIT 0 would block forever
+	}
+	for _, node := range c.keyNodes(keys) {
+		n, err := node.Cmd("WAIT", opt.WaitReplicas, timeout).Int()
+		if err != nil {
+			return fmt.Errorf("WAIT failed: %s", err)
+		}
+		if n < opt.WaitReplicas {
+			return fmt.Errorf("the lock was replicated to %d of %d replicas within %s", n, opt.WaitReplicas, opt.WaitReplicasTimeout)
+		}
+	}
+	return nil
 }
 
-func run() int {
-	opt, key, program, args := parseOptions()
-	c, err := connectToRedisServer(opt)
+// ensureTTL verifies that the lock of key has at least opt.RequireTTL
+// seconds remaining, extending it if opt.RequireTTLExtend.
+func ensureTTLs(c *RedisConn, opt *Options, keys []string, token string) error {
+	for _, key := range keys {
+		if err := ensureTTL(c, opt, key, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureTTL(c *RedisConn, opt *Options, key string, token string) error {
+	pttl, err := c.Cmd("PTTL", key).Int64()
 	if err != nil {
-		log.Printf("Redis server seems down: %s\n", err)
-		return ExitCodeError
+		return fmt.Errorf("could not get TTL of %s: %s", key, err)
 	}
-	defer c.Close()
+	required := int64(opt.RequireTTL) * 1000
+	if pttl >= required {
+		return nil
+	}
+	if !opt.RequireTTLExtend {
+		return fmt.Errorf("lock %s has only %dms remaining. %ds is required", key, pttl, opt.RequireTTL)
+	}
+	switch err := setlock.NewHandle(c, key, token).Extend(opt.RequireTTL); err {
+	case nil:
+	case setlock.ErrNotHeld:
+		return fmt.Errorf("could not extend TTL of %s: the lock was lost", key)
+	default:
+		return fmt.Errorf("could not extend TTL of %s: %s", key, err)
+	}
+	return nil
+}
 
-	if !validateRedisVersion(c) {
-		return ExitCodeError
+// releaseLocks releases all of keys, returning the first error.
+func releaseLocks(c *RedisConn, opt *Options, keys []string, token string) (err error) {
+	for _, key := range keys {
+		if e := releaseLock(c, opt, key, token); e != nil && err == nil {
+			err = e
+		}
 	}
-	token, err := tryGetLock(c, opt, key)
-	if err == nil {
-		defer releaseLock(c, opt, key, token)
-		code := invokeCommand(program, args)
-		return code
+	return err
+}
+
+// releaseLock releases the lock of key. When the connection was lost, e.g.
+// the redis-server restarted while the command ran, it reconnects and
+// retries up to ReleaseRetries times.
+func releaseLock(c *RedisConn, opt *Options, key string, token string) (err error) {
+	if opt.Keep {
+		return nil
 	} else {
-		log.Println(err)
-		return opt.ExitCode
+		r := unlock(c, opt, key, token)
+		retried := false
+		for i := 1; isConnError(r.Err) && i <= ReleaseRetries; i++ {
+			logEvent("warn", key, r.Err, "connection lost on releasing the lock %s. reconnecting (%d/%d)", key, i, ReleaseRetries)
+			if err := c.Reconnect(); err != nil {
+				logEvent("warn", key, err, "could not reconnect")
+				continue
+			}
+			r = unlock(c, opt, key, token)
+			retried = true
+		}
+		if r.Err != nil {
+			return r.Err
+		}
+		if n, _ := r.Int(); n == 0 {
+			if retried {
+				// the unlock before the connection was lost may have been applied.
+				logEvent("warn", key, nil, "lock %s was already gone on retry. it was released before the connection was lost, or expired", key)
+				return nil
+			}
+			lockLost(opt, key, token, "expired or taken over before release")
+			return fmt.Errorf("lock %s had expired or been taken over before release. -expires %ds may be too short for the command", key, opt.Expires)
+		}
+		if !opt.VerifyRelease {
+			return nil
+		}
+		return verifyReleased(c, key, token)
 	}
 }
 
-func connectToRedisServer(opt *Options) (c *redis.Client, err error) {
-	timeout := 0
-	if opt.Wait {
-		timeout = opt.Expires
+func unlock(c *RedisConn, opt *Options, key string, token string) *redis.Reply {
+	if opt.Shared {
+		return releaseSharedLock(c, key, token)
 	}
-	start := time.Now()
-	for {
-		c, err = redis.DialTimeout("tcp", opt.Redis, time.Duration(timeout)*time.Second)
-		if err == nil {
-			break
+	return c.EvalScript(setlock.UnlockLUAScript, 1, key, token)
+}
+
+// isConnError tells whether err is of the connection, rather than an error
+// reply of the redis-server.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(*redis.CmdError)
+	return !ok
+}
+
+// verifyReleased confirms that key no longer holds token, retrying briefly
+// while a stale value may still be seen.
+func verifyReleased(c *RedisConn, key string, token string) error {
+	for i := 0; i < VerifyReleaseRetries; i++ {
+		r := c.Cmd("GET", key)
+		if r.Err != nil {
+			return r.Err
 		}
-		end := time.Now()
-		elapsed := int(end.Sub(start) / time.Millisecond) // msec
-		if elapsed >= timeout*1000 {
-			break
+		if v, _ := r.Str(); r.Type == redis.NilReply || setlock.ParseHolder(v).Token != token {
+			return nil
 		}
 		time.Sleep(RetryInterval)
 	}
-	return c, err
+	return fmt.Errorf("lock %s still exists after release", key)
 }
 
-func validateRedisVersion(c *redis.Client) bool {
-	version := ""
-
-	r := c.Cmd("info")
-	info, _ := r.Str()
-	for _, line := range strings.Split(info, "\n") {
-		pair := strings.SplitN(line, ":", 2)
-		if pair[0] == "redis_version" {
-			version = pair[1]
-			break
-		}
+// checkSuccessMarker returns an error unless the success marker exists and,
+// if maxAge is not zero, was set within maxAge.
+func checkSuccessMarker(c *RedisConn, marker string, maxAge time.Duration) error {
+	r := c.Cmd("GET", marker)
+	if r.Err != nil {
+		return fmt.Errorf("could not get success marker %s: %s", marker, r.Err)
 	}
-	if version == "" {
-		log.Printf("could not detect Redis server version from INFO outout. %s", info)
-		return false
+	if r.Type == redis.NilReply {
+		return fmt.Errorf("success marker %s does not exist", marker)
+	}
+	if maxAge <= 0 {
+		return nil
+	}
+	v, _ := r.Str()
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("success marker %s has no timestamp: %s", marker, v)
+	}
+	if age := time.Now().Sub(time.Unix(ts, 0)); age > maxAge {
+		return fmt.Errorf("success marker %s is stale. set %s ago", marker, age)
 	}
+	return nil
+}
 
-	vNumbers := strings.SplitN(version, ".", 3)
-	major, _ := strconv.Atoi(vNumbers[0])
-	minor, _ := strconv.Atoi(vNumbers[1])
-	rev, _ := strconv.Atoi(vNumbers[2])
-	if (major >= 3) || (major == 2 && minor >= 7) || (major == 2 && minor == 6 && rev >= 12) {
-		return true
+// countRun counts a run of key in the current fixed window, and returns an
+// error if it exceeds opt.MaxRuns. The counter KEY:runs expires at the end
+// of the window, which starts at the first run counted.
+func countRun(c *RedisConn, opt *Options, key string) error {
+	counter := key + ":runs"
+	n, err := c.Cmd("EVAL", CountLUAScript, 1, counter, int64(opt.Window/time.Millisecond)).Int()
+	if err != nil {
+		return fmt.Errorf("could not count runs by %s: %s", counter, err)
 	}
-	log.Printf("required Redis server version >= 2.6.12. current server version is %s\n", version)
-	return false
+	if n > opt.MaxRuns {
+		return fmt.Errorf("%s already ran %d times within %s", key, opt.MaxRuns, opt.Window)
+	}
+	return nil
 }
 
-func tryGetLock(c *redis.Client, opt *Options, key string) (token string, err error) {
-	token = createToken()
-	gotLock := false
+// waitForKeyAbsent polls until key does not exist. It gives up at once
+// without opt.Wait, or after opt.WaitTimeout (opt.Expires seconds if zero).
+func waitForKeyAbsent(ctx context.Context, c *RedisConn, opt *Options, key string) error {
+	timeout := time.Duration(opt.Expires) * time.Second
+	if opt.WaitTimeout > 0 {
+		timeout = opt.WaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
 	for {
-		r := c.Cmd("SET", key, token, "EX", opt.Expires, "NX")
-		locked, _ := r.Str()
-		if locked != "" {
-			gotLock = true
-			break
-		} else if !opt.Wait {
-			break
-		} else {
-			time.Sleep(RetryInterval)
+		n, err := c.Cmd("EXISTS", key).Int()
+		if err != nil {
+			return fmt.Errorf("could not check %s: %s", key, err)
+		}
+		if n == 0 {
+			return nil
+		}
+		if !opt.Wait || time.Now().After(deadline) {
+			return fmt.Errorf("%s still exists", key)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RetryInterval):
 		}
 	}
-	if gotLock {
-		return token, nil
-	} else {
-		return "", errors.New("unable to lock")
+}
+
+// setSuccessMarker sets the success marker to the current unix time.
+func setSuccessMarker(c *RedisConn, marker string) error {
+	return c.Cmd("SET", marker, time.Now().Unix()).Err
+}
+
+// runCleanup runs f, which cleans up after the command exited, with a copy
+// of c. It gives up waiting for f after timeout so that a slow redis-server
+// can not delay exiting with the command's exit code. As f goes on using the
+// connection then, c is dropped: it fails all the commands until it is
+// reconnected.
+func runCleanup(c *RedisConn, name string, timeout time.Duration, f func(*RedisConn) error) error {
+	cc := *c
+	done := make(chan error, 1)
+	go func() {
+		done <- f(&cc)
+	}()
+	var err error
+	select {
+	case err = <-done:
+		*c = cc // f may have reconnected it
+	case <-time.After(timeout):
+		err = fmt.Errorf("did not finish within %s", timeout)
+		c.dropped = true
+	}
+	if err != nil {
+		logEvent("error", "", err, "%s failed", name)
 	}
+	return err
 }
 
-func releaseLock(c *redis.Client, opt *Options, key string, token string) (err error) {
-	if opt.Keep {
-		return nil
-	} else {
-		r := c.Cmd("EVAL", UnlockLUAScript, 1, key, token)
-		return r.Err
+// runOnLocked runs the -on-locked program with key as the argument, after
+// giving up the lock held by another process. For a single key, the holder
+// is in SETLOCK_HOLDER_HOST, SETLOCK_HOLDER_PID and SETLOCK_HOLDER_TIME (unix
+// time) if it is known. Its failure is only logged.
+func runOnLocked(c *RedisConn, opt *Options, key string, keys []string) {
+	env := []string{"SETLOCK_KEY=" + key}
+	if len(keys) == 1 {
+		if v, err := c.Cmd("GET", keys[0]).Str(); err == nil {
+			if h := setlock.ParseHolder(v); h.Host != "" {
+				env = append(env,
+					"SETLOCK_HOLDER_HOST="+h.Host,
+					"SETLOCK_HOLDER_PID="+strconv.Itoa(h.PID),
+					"SETLOCK_HOLDER_TIME="+strconv.FormatInt(h.Time.Unix(), 10),
+				)
+			}
+		}
+	}
+	o := *opt
+	o.StdinLine = ""
+	o.NoStdin = true
+	o.ReadyPattern = nil
+	o.CommandTimeout = 0
+	if code, _ := invokeCommand(&o, opt.OnLocked, []string{key}, env, nil); code != 0 {
+		logEvent("warn", key, nil, "-on-locked %s exited %d", opt.OnLocked, code)
+	}
+}
+
+// runHook runs the shell command line with the additional environment.
+func runHook(cmdline string, env []string) error {
+	cmd := exec.Command("/bin/sh", "-c", cmdline)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// delayRelease sleeps for d before the lock is released. A trapped signal
+// ends the delay immediately.
+func delayRelease(d time.Duration) {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, TrapSignals...)
+	defer signal.Stop(signalCh)
+	select {
+	case <-time.After(d):
+	case s := <-signalCh:
+		log.Printf("Got signal: %s. releasing the lock", s)
+	}
+}
+
+// isTerminal tells whether f is a terminal, or rather a character device
+// other than /dev/null (e.g. the stdin of a cron job).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
 	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
 }
 
-func invokeCommand(program string, args []string) (code int) {
+// isClosedPipe tells whether err is of writing to the stdin of the command
+// which was closed by the command (EPIPE) or by exec.Cmd.Wait after it
+// exited. The rest of our stdin is not for the command then.
+func isClosedPipe(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EPIPE || err == os.ErrClosed
+}
+
+func invokeCommand(opt *Options, program string, args []string, env []string, files []*os.File) (code int, sig os.Signal) {
 	cmd := exec.Command(program, args...)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Println(err)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.ExtraFiles = files
+	var stdin io.WriteCloser
+	interactive := false
+	switch {
+	case opt.NoStdin:
+		// cmd.Stdin nil is /dev/null.
+	case opt.StdinLine == "" && isTerminal(os.Stdin):
+		// given as is, so that the command can use the terminal, and
+		// nothing is left reading it after the command exited.
+		cmd.Stdin = os.Stdin
+		interactive = true
+	default:
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			log.Println(err)
+		}
 	}
-	stdout, err := cmd.StdoutPipe()
+	// Not StdoutPipe and StderrPipe, as Wait closes them as soon as the
+	// command exited, discarding the output not read yet.
+	stdout, childStdout, err := os.Pipe()
 	if err != nil {
 		log.Println(err)
 	}
-	stderr, err := cmd.StderrPipe()
+	stderr, childStderr, err := os.Pipe()
 	if err != nil {
 		log.Println(err)
 	}
+	cmd.Stdout, cmd.Stderr = childStdout, childStderr
+	if !interactive {
+		// A process group of its own, so that the signals reach the
+		// processes it spawned (e.g. by bash -c) as well. An interactive
+		// command stays in ours, the foreground one of the terminal, to
+		// read it; the terminal signals the whole group then.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 	err = cmd.Start()
-	if err != nil {
-		log.Println(err)
+	childStdout.Close()
+	childStderr.Close()
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
 	}
-	go func() {
-		_, err := io.Copy(stdin, os.Stdin)
-		if err == nil {
+	if err != nil {
+		// never taken for a success of the command, e.g. by -set-success.
+		logError("", err)
+		stdout.Close()
+		stderr.Close()
+		if stdin != nil {
 			stdin.Close()
-		} else {
-			log.Println(err)
+		}
+		return ExitCodeError, nil
+	}
+	if stdin != nil {
+		go func() {
+			var err error
+			if opt.StdinLine != "" {
+				_, err = io.WriteString(stdin, opt.StdinLine+"\n")
+			} else {
+				// Not copy_file_range(2) by io.Copy of *os.File, which
+				// locks the pipe while waiting for os.Stdin: in -watch the
+				// copy left by the previous run may hold os.Stdin, and Wait
+				// could never close the pipe then.
+				_, err = io.Copy(struct{ io.Writer }{stdin}, struct{ io.Reader }{os.Stdin})
+			}
+			if err != nil && !isClosedPipe(err) {
+				log.Println(err)
+			}
 			stdin.Close()
+		}()
+	}
+	var stdoutW, stderrW io.Writer = os.Stdout, os.Stderr
+	var jsonOut, jsonErr *jsonLineWriter
+	if opt.WrapOutputJSON {
+		mu := &sync.Mutex{}
+		jsonOut = newJSONLineWriter(os.Stdout, "stdout", mu)
+		jsonErr = newJSONLineWriter(os.Stdout, "stderr", mu)
+		stdoutW, stderrW = jsonOut, jsonErr
+	}
+	if opt.ReadyPattern != nil {
+		stdoutW = newReadyWriter(stdoutW, opt.ReadyPattern, func() { notifyReady(opt.ReadyFD) })
+	}
+	var copying sync.WaitGroup
+	copying.Add(2)
+	go func() {
+		defer copying.Done()
+		io.Copy(stdoutW, stdout)
+		if jsonOut != nil {
+			jsonOut.Flush()
+		}
+	}()
+	go func() {
+		defer copying.Done()
+		io.Copy(stderrW, stderr)
+		if jsonErr != nil {
+			jsonErr.Flush()
 		}
 	}()
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
+
+	// signalCommand sends s to the process group of the command.
+	signalCommand := func(s os.Signal) {
+		if sig, ok := s.(syscall.Signal); ok && !interactive {
+			syscall.Kill(-cmd.Process.Pid, sig)
+			return
+		}
+		cmd.Process.Signal(s)
+	}
 
 	var cmdErr error
 	cmdCh := make(chan error)
@@ -244,22 +2066,86 @@ func invokeCommand(program string, args []string) (code int) {
 		cmdCh <- cmd.Wait()
 	}()
 
+	// waitStopped waits for the command to exit after it was signalled,
+	// killing it after grace (never if zero).
+	waitStopped := func(grace time.Duration) {
+		var killCh <-chan time.Time
+		if grace > 0 {
+			killCh = time.After(grace)
+		}
+		drainCh := time.After(DrainTimeout)
+		for {
+			select {
+			case <-cmdCh:
+				return
+			case <-drainCh:
+				// The child may be blocked writing to a pipe which nobody
+				// reads any more. Close them so that the write fails.
+				logEvent("warn", "", nil, "command did not exit within %s after the signal. closing its stdout and stderr", DrainTimeout)
+				stdout.Close()
+				stderr.Close()
+				drainCh = nil
+			case <-killCh:
+				logEvent("warn", "", nil, "command did not exit within %s after the signal. sending SIGKILL", grace)
+				signalCommand(syscall.SIGKILL)
+				killCh = nil
+			}
+		}
+	}
+
+	var timeoutCh <-chan time.Time
+	if opt.CommandTimeout > 0 {
+		timer := time.NewTimer(opt.CommandTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, TrapSignals...)
+	defer signal.Stop(signalCh)
 	select {
 	case s := <-signalCh:
-		cmd.Process.Signal(s) // forward to child
+		sig = s
+		signalCommand(s) // forward to child
 		switch sig := s.(type) {
 		case syscall.Signal:
-			code = int(sig)
-			log.Printf("Got signal: %s(%d)", sig, sig)
+			code = signalExitCode(sig)
+			logEvent("info", "", nil, "Got signal: %s(%d)", sig, sig)
 		default:
 			code = -1
 		}
-		<-cmdCh
+		grace := opt.KillTimeout
+		if s == syscall.SIGINT && opt.InterruptGrace > 0 {
+			grace = opt.InterruptGrace
+		}
+		waitStopped(grace)
+	case <-timeoutCh:
+		code = opt.TimeoutExitCode
+		logEvent("warn", "", nil, "command did not exit within -command-timeout %s. sending SIGTERM", opt.CommandTimeout)
+		signalCommand(syscall.SIGTERM)
+		grace := opt.KillTimeout
+		if grace <= 0 {
+			grace = DefaultTimeoutGrace
+		}
+		waitStopped(grace)
 	case cmdErr = <-cmdCh:
 	}
 
+	copied := make(chan struct{})
+	go func() {
+		copying.Wait()
+		close(copied)
+	}()
+	// Bounded even when the command exited by itself: a process it left in
+	// the background (e.g. by sh -c 'daemon &') may hold the pipes open
+	// forever, and so the lock.
+	select {
+	case <-copied:
+	case <-time.After(DrainTimeout):
+		log.Printf("output of the command was not copied within %s after it exited. a process it spawned may hold its stdout or stderr", DrainTimeout)
+	}
+	stdout.Close()
+	stderr.Close()
+
 	// http://qiita.com/hnakamur/items/5e6f22bda8334e190f63
 	if cmdErr != nil {
 		if e2, ok := cmdErr.(*exec.ExitError); ok {
@@ -267,15 +2153,40 @@ func invokeCommand(program string, args []string) (code int) {
 				code = s.ExitStatus()
 			} else {
 				log.Println("Unimplemented for system where exec.ExitError.Sys() is not syscall.WaitStatus.")
-				return ExitCodeError
+				return ExitCodeError, sig
 			}
 		}
 	}
-	return code
+	return code, sig
+}
+
+// stringsFlag is a flag.Value which can be given repeatedly.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }
 
-func createToken() string {
-	b := make([]byte, 16)
-	crand.Read(b)
-	return hex.EncodeToString(b)
+// writeFileAtomically writes result, of -exit-code-file or -result-file, to
+// path atomically, by renaming a temporary file in the same directory.
+func writeFileAtomically(path string, result string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(f, result); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// MaxReadyLineLength is the longest line readyWriter keeps to match.
+const MaxReadyLineLength = 64 * 1024
+
+// readyWriter writes to w, and calls onReady once when a line written
+// matches re. The output is written first, so matching never delays it, and
+// onReady is called before Write returns, so that the notification is done
+// by the time the output of the command was copied.
+type readyWriter struct {
+	w       io.Writer
+	re      *regexp.Regexp
+	onReady func()
+	line    []byte
+	ready   bool
+}
+
+func newReadyWriter(w io.Writer, re *regexp.Regexp, onReady func()) *readyWriter {
+	return &readyWriter{w: w, re: re, onReady: onReady}
+}
+
+func (rw *readyWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if rw.ready {
+		return n, err
+	}
+	rw.line = append(rw.line, p[:n]...)
+	for {
+		i := bytes.IndexByte(rw.line, '\n')
+		if i < 0 {
+			break
+		}
+		if rw.re.Match(rw.line[:i]) {
+			rw.ready = true
+			rw.line = nil
+			rw.onReady()
+			return n, err
+		}
+		rw.line = rw.line[i+1:]
+	}
+	if len(rw.line) > MaxReadyLineLength {
+		rw.line = rw.line[len(rw.line)-MaxReadyLineLength:]
+	}
+	return n, err
+}
+
+// readyFDOnce writes to -ready-fd only once per process, as it is closed
+// after writing: the later runs of -watch only log that they are ready.
+var readyFDOnce sync.Once
+
+// notifyReady logs the command is ready, and writes "ready" to fd if it is
+// not negative and not written yet.
+func notifyReady(fd int) {
+	log.Println("command is ready")
+	if fd < 0 {
+		return
+	}
+	readyFDOnce.Do(func() {
+		f := os.NewFile(uintptr(fd), "ready-fd")
+		defer f.Close()
+		if _, err := io.WriteString(f, "ready\n"); err != nil {
+			log.Printf("could not write to -ready-fd %d: %s\n", fd, err)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+const RedactedText = "*****"
+
+var (
+	secretsMu sync.Mutex
+	secrets   []string
+)
+
+// addSecret registers s (e.g. a password) that must not appear in any output.
+func addSecret(s string) {
+	if s == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, s)
+}
+
+// redact replaces every registered secret in s.
+func redact(s string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, RedactedText, -1)
+	}
+	return s
+}
+
+// redactWriter is an io.Writer which redacts secrets before writing to w.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (rw redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
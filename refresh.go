@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"log"
+	"time"
+)
+
+// startRefresh extends the TTL of the locks of keys back to opt.Expires every
+// half of it, while the program runs. The lock is extended only while it
+// still holds token, so a lock taken over by another process is never
+// extended. The returned function stops refreshing and waits until the
+// goroutine exited; c must not be used until it returned.
+func startRefresh(c *RedisConn, opt *Options, keys []string, token string) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	interval := time.Duration(opt.Expires) * time.Second / 2
+	if interval <= 0 {
+		interval = RetryInterval
+	}
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for _, key := range keys {
+				err := setlock.NewHandle(c, key, token).Extend(opt.Expires)
+				if err == setlock.ErrNotHeld {
+					log.Printf("could not refresh the lock %s: the lock was lost\n", key)
+					lockLost(opt, key, token, "lost on refresh")
+					return
+				}
+				if err != nil {
+					log.Printf("could not refresh the lock %s: %s\n", key, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
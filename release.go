@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"github.com/fzzy/radix/redis"
+)
+
+// runRelease removes the lock of key left by a holder which died, instead
+// of running a program. With opt.Token it is removed only while it holds
+// the token, and with opt.Force unconditionally. It prints the holder
+// first, and exits 1 if key was not locked or did not hold the token.
+func runRelease(opt *Options, key string) int {
+	c, err := connectForProbe(opt)
+	if err != nil {
+		logEvent("error", key, err, "Redis server seems down")
+		return ExitCodeError
+	}
+	defer c.Close()
+
+	if code := printHolder(c, key); code != 0 {
+		return code
+	}
+	v, _ := c.Cmd("GET", key).Str()
+	if opt.Token != "" {
+		if setlock.ParseHolder(v).Token != opt.Token {
+			fmt.Printf("%s is not held by token %s\n", key, opt.Token)
+			return 1
+		}
+	}
+	if opt.DryRun {
+		fmt.Printf("would remove %s\n", key)
+		return 0
+	}
+	var r *redis.Reply
+	if opt.Force && v == SharedLockValue {
+		r = c.Cmd("DEL", key, readersKey(key))
+	} else if opt.Force {
+		r = c.Cmd("DEL", key)
+	} else {
+		r = c.EvalScript(setlock.UnlockLUAScript, 1, key, opt.Token)
+	}
+	n, err := r.Int()
+	if err != nil {
+		logError(key, fmt.Errorf("could not remove %s: %s", key, err))
+		return ExitCodeError
+	}
+	if n == 0 {
+		// released or taken over just now.
+		fmt.Printf("%s was not removed: it is not held by token %s any more\n", key, opt.Token)
+		return 1
+	}
+	fmt.Printf("removed %s\n", key)
+	return 0
+}
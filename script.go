@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/fzzy/radix/redis"
+	"strings"
+)
+
+// EvalScript runs script by EVALSHA with its SHA1 digest, so that the source
+// is sent only when the redis-server does not have it cached (NOSCRIPT),
+// e.g. on the first use or after a restart. Then it falls back to EVAL,
+// which caches the script for the next time.
+func (c *RedisConn) EvalScript(script string, numKeys int, args ...interface{}) *redis.Reply {
+	sum := sha1.Sum([]byte(script))
+	r := c.Cmd("EVALSHA", append([]interface{}{hex.EncodeToString(sum[:]), numKeys}, args...)...)
+	if r.Type == redis.ErrorReply && r.Err != nil && strings.HasPrefix(r.Err.Error(), "NOSCRIPT") {
+		return c.Cmd("EVAL", append([]interface{}{script, numKeys}, args...)...)
+	}
+	return r
+}
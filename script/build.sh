@@ -3,12 +3,14 @@
 set -e
 set -u
 
+LDFLAGS="-X main.commit=$(git rev-parse --short HEAD)"
+
 for GOOS in darwin
 do
     for GOARCH in 386 amd64
     do
         mkdir -p "bin/$GOOS-$GOARCH"
-        GOOS="$GOOS" GOARCH="$GOARCH" go build -o "bin/$GOOS-$GOARCH/go-redis-setlock"
+        GOOS="$GOOS" GOARCH="$GOARCH" go build -ldflags "$LDFLAGS" -o "bin/$GOOS-$GOARCH/go-redis-setlock"
     done
 done
 
@@ -17,6 +19,6 @@ do
     for GOARCH in 386 amd64 arm
     do
         mkdir -p "bin/$GOOS-$GOARCH"
-        GOOS="$GOOS" GOARCH="$GOARCH" go build -o "bin/$GOOS-$GOARCH/go-redis-setlock"
+        GOOS="$GOOS" GOARCH="$GOARCH" go build -ldflags "$LDFLAGS" -o "bin/$GOOS-$GOARCH/go-redis-setlock"
     done
 done
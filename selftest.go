@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+)
+
+// runSelfTest exercises the whole lock lifecycle with a temporary key
+// against the configured redis-server, and reports each step to stdout.
+func runSelfTest(opt *Options) int {
+	ok := true
+	report := func(step string, err error) bool {
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", step, err)
+			ok = false
+			return false
+		}
+		fmt.Printf("ok   %s\n", step)
+		return true
+	}
+
+	c, err := connectToRedisServer(context.Background(), opt)
+	if !report("connect", err) {
+		return ExitCodeError
+	}
+	defer c.Close()
+
+	if opt.SkipVersionCheck {
+		fmt.Println("skip version")
+	} else if !validateRedisVersion(c) {
+		report("version", errors.New("unsupported redis-server"))
+		return ExitCodeError
+	} else {
+		report("version", nil)
+	}
+
+	key := opt.Prefix + "go-redis-setlock-selftest-" + setlock.NewToken()
+	lock, err := setlock.Lock(context.Background(), c, key, setlock.Options{Expires: opt.Expires})
+	if !report("acquire "+key, err) {
+		return ExitCodeError
+	}
+	report("extend", lock.Extend(opt.Expires))
+	report("release", lock.Release())
+
+	n, err := c.Cmd("EXISTS", key).Int()
+	if err == nil && n != 0 {
+		err = errors.New("the key still exists")
+	}
+	report("verify released", err)
+
+	if !ok {
+		return ExitCodeError
+	}
+	return 0
+}
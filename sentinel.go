@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"net"
+	"strings"
+	"time"
+)
+
+// resolveMaster asks the sentinels listed in opt.Redis for the address of
+// the master opt.MasterName, trying them in order until one answers.
+func resolveMaster(opt *Options, timeout time.Duration) (string, error) {
+	var errs []string
+	for _, addr := range strings.Split(opt.Redis, ",") {
+		addr = strings.TrimSpace(addr)
+		master, err := askSentinel(addr, opt.MasterName, timeout)
+		if err == nil {
+			return master, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+	}
+	return "", fmt.Errorf("could not get the master %s from the sentinels: %s", opt.MasterName, strings.Join(errs, ", "))
+}
+
+func askSentinel(addr string, name string, timeout time.Duration) (string, error) {
+	c, err := redis.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	r := c.Cmd("SENTINEL", "get-master-addr-by-name", name)
+	if r.Err != nil {
+		return "", r.Err
+	}
+	if r.Type == redis.NilReply {
+		return "", fmt.Errorf("unknown master %s", name)
+	}
+	hostPort, err := r.List()
+	if err != nil || len(hostPort) != 2 {
+		return "", fmt.Errorf("unexpected reply %s", r)
+	}
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
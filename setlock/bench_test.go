@@ -0,0 +1,64 @@
+package setlock_test
+
+import (
+	"context"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"github.com/fzzy/radix/redis"
+	"net"
+	"testing"
+	"time"
+)
+
+// BenchmarkLock locks and releases a key, with TCP_NODELAY set on the
+// connection (as go-redis-setlock does by default) and without. The holder
+// (host, PID and time) is stored by the SET itself, so locking takes a
+// single round trip and releasing another one, which it reports as
+// round-trips/op. Over loopback the two take about the same time, as each
+// command is a single write which is ACKed at once: this does not measure
+// the latency Nagle's algorithm adds on a real network.
+func BenchmarkLock(b *testing.B) {
+	s, err := newFakeRedis()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, bm := range []struct {
+		name    string
+		noDelay bool
+	}{
+		{"tcp-nodelay", true},
+		{"tcp-nodelay=false", false},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			conn, err := net.DialTimeout("tcp", s.Addr(), time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.(*net.TCPConn).SetNoDelay(bm.noDelay)
+			c, err := redis.NewClient(conn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			benchmarkLock(b, s, c)
+		})
+	}
+}
+
+func benchmarkLock(b *testing.B, s *fakeRedis, c *redis.Client) {
+	ctx := context.Background()
+	start := s.Commands()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock, err := setlock.Lock(ctx, c, "bench", setlock.Options{Expires: 60})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := lock.Release(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(s.Commands()-start)/float64(b.N), "round-trips/op")
+}
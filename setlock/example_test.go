@@ -0,0 +1,85 @@
+package setlock_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"github.com/fzzy/radix/redis"
+	"log"
+	"time"
+)
+
+func ExampleLock() {
+	// a redis-server in process, as the example runs by go test.
+	s, err := newFakeRedis()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := redis.DialTimeout("tcp", s.Addr(), 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	lock, err := setlock.Lock(ctx, c, "my-job", setlock.Options{Expires: 60, Wait: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	func() {
+		// run the job holding the lock
+		fmt.Println("locked", lock.Key)
+	}()
+
+	if err := lock.Release(); err != nil {
+		log.Println("the lock was lost:", err)
+	}
+	// Output: locked my-job
+}
+
+func ExampleRetry() {
+	s, err := newFakeRedis()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := redis.DialTimeout("tcp", s.Addr(), 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	// lock both of the keys, or neither.
+	keys := []string{"job-a", "job-b"}
+	token := setlock.NewToken()
+	var handles []*setlock.Handle
+	_, err = setlock.Retry(context.Background(), setlock.Options{Wait: true, WaitTimeout: 10 * time.Second}, func() (bool, error) {
+		for _, key := range keys {
+			locked, err := setlock.ParseLockReply(c.Cmd("SET", key, setlock.NewHolder(token).String(), "EX", 60, "NX"))
+			if err != nil || !locked {
+				for _, h := range handles {
+					h.Release()
+				}
+				handles = nil
+				return false, err
+			}
+			handles = append(handles, setlock.NewHandle(c, key, token))
+		}
+		return true, nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, h := range handles {
+		fmt.Println("locked", h.Key)
+		h.Release()
+	}
+	// Output:
+	// locked job-a
+	// locked job-b
+}
@@ -0,0 +1,132 @@
+package setlock_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// fakeRedis is a redis-server in process for the examples and the
+// benchmarks. It knows only the commands of Lock, Extend and Release, and
+// counts the commands it received (the round trips, as nothing is
+// pipelined).
+type fakeRedis struct {
+	ln       net.Listener
+	commands int64
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func newFakeRedis() (*fakeRedis, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeRedis{ln: ln, keys: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) Close() error {
+	return s.ln.Close()
+}
+
+// Commands returns the number of the commands received so far.
+func (s *fakeRedis) Commands() int64 {
+	return atomic.LoadInt64(&s.commands)
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.commands, 1)
+		if _, err := io.WriteString(conn, s.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) reply(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "SET": // SET key value EX n NX
+		if _, ok := s.keys[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		s.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		v, ok := s.keys[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "EVAL": // EVAL script 1 key token [expires]
+		if setlock.ParseHolder(s.keys[args[3]]).Token != args[4] {
+			return ":0\r\n"
+		}
+		if args[1] == setlock.UnlockLUAScript {
+			delete(s.keys, args[3])
+		}
+		return ":1\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// readCommand reads a command as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		l, err := readLength(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
+
+func readLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" || line[0] != prefix {
+		return 0, fmt.Errorf("unexpected %q", line)
+	}
+	return strconv.Atoi(line[1:])
+}
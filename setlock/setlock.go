@@ -0,0 +1,235 @@
+// Package setlock is the locking of go-redis-setlock, for programs which
+// lock in process instead of running the go-redis-setlock command.
+//
+// A lock is a key set by SET key value EX expires NX, where value is a Holder:
+// a random token followed by the host name, the PID and the time of the
+// holder. Only the holder which knows the token can extend or release it.
+package setlock
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/fzzy/radix/redis"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UnlockLUAScript      = "local v = redis.call(\"get\",KEYS[1])\nif v == ARGV[1] or (v and string.sub(v,1,#ARGV[1]+1) == ARGV[1]..\";\")\nthen\nreturn redis.call(\"del\",KEYS[1])\nelse\nreturn 0\nend\n"
+	ExtendLUAScript      = "local v = redis.call(\"get\",KEYS[1])\nif v == ARGV[1] or (v and string.sub(v,1,#ARGV[1]+1) == ARGV[1]..\";\")\nthen\nreturn redis.call(\"expire\",KEYS[1],ARGV[2])\nelse\nreturn 0\nend\n"
+	DefaultExpires       = 86400
+	DefaultRetryInterval = 500 * time.Millisecond
+)
+
+// ErrLocked is returned by Lock when the key is locked by another.
+var ErrLocked = errors.New("unable to lock")
+
+// ErrAmbiguousReply is returned by ParseLockReply for a reply which tells
+// neither the lock was acquired nor it was not.
+var ErrAmbiguousReply = errors.New("ambiguous reply")
+
+// ErrNotHeld is returned by Handle.Extend and Handle.Release when the lock
+// is not held by the handle any more, e.g. it expired.
+var ErrNotHeld = errors.New("the lock is not held")
+
+// Cmder is a connection to the redis-server, such as *redis.Client.
+type Cmder interface {
+	Cmd(cmd string, args ...interface{}) *redis.Reply
+}
+
+// Options are the options of Lock.
+type Options struct {
+	// Expires is the TTL of the lock in seconds. DefaultExpires if zero.
+	Expires int
+	// Wait makes Lock wait until the key is available, instead of
+	// returning ErrLocked.
+	Wait bool
+	// RetryInterval is the pause between the attempts while waiting.
+	// DefaultRetryInterval if zero.
+	RetryInterval time.Duration
+	// WaitTimeout makes Lock give up waiting with ErrLocked when the next
+	// attempt would be later than the duration after the first one. No
+	// limit if zero.
+	WaitTimeout time.Duration
+	// OnWait is called before each pause while waiting, with the number of
+	// the attempts so far and the time since the first one.
+	OnWait func(attempts int, waited time.Duration)
+}
+
+// Handle is an acquired lock.
+type Handle struct {
+	c     Cmder
+	Key   string
+	Token string
+}
+
+// Lock locks key on c. With opt.Wait it retries until the key is available
+// or ctx is done, returning ctx.Err() in the latter case.
+func Lock(ctx context.Context, c Cmder, key string, opt Options) (*Handle, error) {
+	expires := opt.Expires
+	if expires <= 0 {
+		expires = DefaultExpires
+	}
+	token := NewToken()
+	_, err := Retry(ctx, opt, func() (bool, error) {
+		locked, err := ParseLockReply(c.Cmd("SET", key, NewHolder(token).String(), "EX", expires, "NX"))
+		if err == ErrAmbiguousReply {
+			// the SET may have been applied.
+			c.Cmd("EVAL", UnlockLUAScript, 1, key, token)
+		}
+		return locked, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewHandle(c, key, token), nil
+}
+
+// Retry calls try, an attempt to lock, as Lock retries SET: until it locks
+// or fails, once without opt.Wait, and with opt.Wait until ctx is done or
+// opt.WaitTimeout. It returns the number of the attempts, and ErrLocked when
+// it gave up. This is for the programs which lock by other than a SET of a
+// key, e.g. several keys at once.
+func Retry(ctx context.Context, opt Options, try func() (locked bool, err error)) (attempts int, err error) {
+	interval := opt.RetryInterval
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+	start := time.Now()
+	for {
+		attempts++
+		locked, err := try()
+		if err != nil {
+			return attempts, err
+		}
+		if locked {
+			return attempts, nil
+		}
+		if !opt.Wait {
+			return attempts, ErrLocked
+		}
+		if opt.WaitTimeout > 0 && time.Now().Sub(start)+interval > opt.WaitTimeout {
+			return attempts, ErrLocked
+		}
+		if opt.OnWait != nil {
+			opt.OnWait(attempts, time.Now().Sub(start))
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// NewHandle returns the Handle of the lock of key on c holding token, e.g.
+// acquired by Retry.
+func NewHandle(c Cmder, key string, token string) *Handle {
+	return &Handle{c: c, Key: key, Token: token}
+}
+
+// Extend sets the TTL of the lock to expires seconds.
+func (h *Handle) Extend(expires int) error {
+	n, err := h.c.Cmd("EVAL", ExtendLUAScript, 1, h.Key, h.Token, expires).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// Release deletes the lock, only if it is still held by h.
+func (h *Handle) Release() error {
+	n, err := h.c.Cmd("EVAL", UnlockLUAScript, 1, h.Key, h.Token).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// ParseLockReply tells whether the reply of SET ... NX acquired the lock,
+// by the kind of the reply: status OK for acquired, nil for locked by
+// another, error for a failed command, and ErrAmbiguousReply for others.
+func ParseLockReply(r *redis.Reply) (locked bool, err error) {
+	switch r.Type {
+	case redis.StatusReply:
+		if s, _ := r.Str(); s == "OK" {
+			return true, nil
+		}
+	case redis.NilReply:
+		return false, nil
+	case redis.ErrorReply:
+		return false, r.Err
+	}
+	return false, ErrAmbiguousReply
+}
+
+// NewToken returns a random token to store in a lock.
+func NewToken() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Holder tells who holds a lock. It is stored in the lock as
+// "token;host;pid;unix time", followed by ";version" if Version is set. The
+// scripts compare only the token, so a lock holding only a token (by
+// go-redis-setlock before Holder) works as well.
+type Holder struct {
+	Token string
+	Host  string
+	PID   int
+	Time  time.Time
+	// Version is the version of the program which locked, optional.
+	Version string
+}
+
+// NewHolder returns the Holder of this process with token.
+func NewHolder(token string) Holder {
+	host, _ := os.Hostname()
+	return Holder{Token: token, Host: host, PID: os.Getpid(), Time: time.Now()}
+}
+
+// String returns the value to store in the lock.
+func (h Holder) String() string {
+	if h.Host == "" && h.PID == 0 && h.Time.IsZero() {
+		return h.Token
+	}
+	fields := []string{
+		h.Token,
+		strings.Replace(h.Host, ";", "", -1),
+		strconv.Itoa(h.PID),
+		strconv.FormatInt(h.Time.Unix(), 10),
+	}
+	if h.Version != "" {
+		fields = append(fields, strings.Replace(h.Version, ";", "", -1))
+	}
+	return strings.Join(fields, ";")
+}
+
+// ParseHolder parses the value of a lock. The fields which can not be
+// parsed are left zero.
+func ParseHolder(v string) Holder {
+	fields := strings.SplitN(v, ";", 5)
+	h := Holder{Token: fields[0]}
+	if len(fields) == 5 {
+		h.Version = fields[4]
+	}
+	if len(fields) >= 4 {
+		h.Host = fields[1]
+		h.PID, _ = strconv.Atoi(fields[2])
+		if ts, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			h.Time = time.Unix(ts, 0)
+		}
+	}
+	return h
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"github.com/fzzy/radix/redis"
+	"strings"
+	"time"
+)
+
+// A shared lock of KEY (-shared) sets KEY to SharedLockValue, so that an
+// exclusive lock (SET KEY ... NX) waits until all the readers released it,
+// and keeps the token of each reader in the sorted set KEY:readers with the
+// unix time in milliseconds it expires at as the score. KEY expires when
+// the last of the readers expires.
+const (
+	SharedLockValue       = "shared"
+	SharedLockLUAScript   = "local v = redis.call(\"get\",KEYS[1])\nif v and v ~= ARGV[4] then\nreturn 0\nend\nredis.call(\"zremrangebyscore\",KEYS[2],\"-inf\",ARGV[3])\nredis.call(\"zadd\",KEYS[2],ARGV[3]+ARGV[2],ARGV[1])\nif redis.call(\"pttl\",KEYS[1]) < tonumber(ARGV[2]) then\nredis.call(\"set\",KEYS[1],ARGV[4],\"PX\",ARGV[2])\nend\nredis.call(\"pexpire\",KEYS[2],redis.call(\"pttl\",KEYS[1]))\nreturn 1\n"
+	SharedUnlockLUAScript = "if redis.call(\"zrem\",KEYS[2],ARGV[1]) == 0 then\nreturn 0\nend\nredis.call(\"zremrangebyscore\",KEYS[2],\"-inf\",ARGV[2])\nif redis.call(\"zcard\",KEYS[2]) == 0 then\nif redis.call(\"get\",KEYS[1]) == ARGV[3] then\nredis.call(\"del\",KEYS[1])\nend\nredis.call(\"del\",KEYS[2])\nend\nreturn 1\n"
+)
+
+// readersKey returns the key of the readers of the shared lock of key.
+func readersKey(key string) string {
+	return key + ":readers"
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// tryGetSharedLock locks key shared with the other -shared processes. It
+// waits (or gives up by -n) while key is locked exclusively, retried by
+// setlock.Retry as tryGetLock.
+func tryGetSharedLock(ctx context.Context, c *RedisConn, opt *Options, key string) (token string, err error) {
+	token = setlock.NewToken()
+	expires := int64(opt.Expires) * 1000
+	start := time.Now()
+	retry := retryOptions(opt, key)
+	retry.OnWait = func(attempts int, waited time.Duration) {
+		logEvent("debug", key, nil, "waiting for lock %s held exclusively by another process, attempt %d, waited %s", key, attempts, waited.Round(time.Millisecond))
+	}
+	attempts, err := setlock.Retry(ctx, retry, func() (bool, error) {
+		n, err := c.Cmd("EVAL", SharedLockLUAScript, 2, key, readersKey(key), token, expires, unixMilli(time.Now()), SharedLockValue).Int()
+		if err != nil {
+			return false, fmt.Errorf("could not lock %s shared: %s", key, err)
+		}
+		return n == 1, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if opt.WaitReplicas > 0 {
+		if err := waitReplicas(c, opt, []string{key}); err != nil {
+			releaseSharedLock(c, key, token)
+			return "", err
+		}
+	}
+	logEvent("debug", key, nil, "acquired lock %s shared, attempt %d, waited %s", key, attempts, time.Now().Sub(start).Round(time.Millisecond))
+	return token, nil
+}
+
+// releaseSharedLock removes token from the readers of key, and deletes key
+// when it was the last one. The reply is 0 when token was not a reader any
+// more, e.g. it expired.
+func releaseSharedLock(c *RedisConn, key string, token string) *redis.Reply {
+	return c.EvalScript(SharedUnlockLUAScript, 2, key, readersKey(key), token, unixMilli(time.Now()), SharedLockValue)
+}
+
+// sharedOptionConflicts returns the options which can not be used with
+// -shared, as they assume KEY holds the token of this process.
+func sharedOptionConflicts(opt *Options) string {
+	var names []string
+	if len(opt.Keys) > 0 {
+		names = append(names, "-keys")
+	}
+	if opt.Slots > 0 {
+		names = append(names, "-slots")
+	}
+	if opt.Refresh {
+		names = append(names, "-refresh")
+	}
+	if opt.RequireTTLExtend {
+		names = append(names, "-require-ttl-extend")
+	}
+	if opt.VerifyRelease {
+		names = append(names, "-verify-release")
+	}
+	if opt.Cluster {
+		names = append(names, "-cluster")
+	}
+	if opt.AcquireCommand != "" {
+		names = append(names, "-acquire-command")
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const DefaultStatsdPrefix = "go_redis_setlock."
+
+// stats is the statsd client enabled by -statsd, or nil.
+var stats *Statsd
+
+// Statsd sends metrics to a statsd server over UDP. Sending is best effort:
+// errors are logged and never fail the lock. All methods are no-op on nil.
+type Statsd struct {
+	conn   net.Conn
+	prefix string
+}
+
+func NewStatsd(addr string, prefix string) (*Statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{conn: conn, prefix: prefix}, nil
+}
+
+func (s *Statsd) send(name string, value string, kind string) {
+	if s == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(s.conn, "%s%s:%s|%s", s.prefix, name, value, kind); err != nil {
+		log.Printf("could not send a metric to statsd: %s\n", err)
+	}
+}
+
+// Timing sends d in milliseconds.
+func (s *Statsd) Timing(name string, d time.Duration) {
+	s.send(name, fmt.Sprintf("%d", d/time.Millisecond), "ms")
+}
+
+func (s *Statsd) Incr(name string) {
+	s.send(name, "1", "c")
+}
+
+func (s *Statsd) Gauge(name string, v int) {
+	s.send(name, fmt.Sprintf("%d", v), "g")
+}
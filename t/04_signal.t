@@ -23,7 +23,7 @@ else {
         $lock_key,
         "perl", "-e", "sleep 5",
     );
-    is $code => POSIX::SIGTERM, "got lock and exit 15(SIGTERM)";
+    is $code => 128 + POSIX::SIGTERM, "got lock and exit 143(128+SIGTERM)";
     ok $elapsed > 2, "run seconds $elapsed > 2";
     ok $elapsed < 3, "run seconds $elapsed < 3";
     exit;
@@ -0,0 +1,24 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $server = stub_redis_server(
+    SET => sub { sleep 3; "+OK\r\n" },
+);
+my $port = $server->port;
+
+subtest "slow SET is given up" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => "127.0.0.1:$port",
+        "--max-acquire-latency" => "500ms",
+        "-n",
+        "slow-lock",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111, "unable to lock and exit 111";
+    ok $elapsed < 2, "elapsed seconds $elapsed < 2";
+};
+
+done_testing;
@@ -0,0 +1,45 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $server = stub_redis_server(
+    EVAL => sub { sleep 5; ":1\r\n" },
+);
+my $port = $server->port;
+
+subtest "slow unlock does not mask the exit code" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => "127.0.0.1:$port",
+        "--cleanup-timeout" => "1s",
+        "slow-unlock",
+        "perl", "-e", "exit 3",
+    );
+    is $code => 3, "exit code of the command";
+    ok $elapsed < 3, "elapsed seconds $elapsed < 3";
+};
+
+subtest "-watch goes on with a new connection after the cleanup timed out" => sub {
+    my $runs = "t/cleanup_timeout.$$";
+    unlink $runs;
+    my $pid = fork();
+    if ($pid == 0) {
+        exec "./go-redis-setlock", "--redis" => "127.0.0.1:$port",
+            "--cleanup-timeout" => "1s", "-watch", "-watch-interval" => "100ms",
+            "slow-unlock", "sh", "-c", "echo run >> $runs";
+        die "exec: $!";
+    }
+    sleep 3;
+    kill TERM => $pid;
+    waitpid $pid, 0;
+    open my $fh, "<", $runs or die $!;
+    my @runs = <$fh>;
+    close $fh;
+    unlink $runs;
+    # the unlock of each run takes 5s, which would block the next one on
+    # the same connection.
+    ok @runs >= 2, "ran @{[ scalar @runs ]} times";
+};
+
+done_testing;
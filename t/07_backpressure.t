@@ -0,0 +1,38 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Time::HiRes qw/ sleep gettimeofday tv_interval /;
+use POSIX qw/ WNOHANG /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+my $port = $server->port;
+
+subtest "child blocked on a slow stdout consumer exits on signal" => sub {
+    pipe(my $reader, my $writer) or die "pipe: $!";
+    my $pid = fork();
+    die "fork: $!" unless defined $pid;
+    if ($pid == 0) {
+        close $reader;
+        open STDOUT, ">&", $writer or die "dup: $!";
+        exec "./go-redis-setlock", "--redis" => "127.0.0.1:$port", "backpressure",
+            "sh", "-c", q{trap "exit 0" TERM; yes | head -c 10000000; sleep 100};
+        die "exec: $!";
+    }
+    close $writer;    # keep $reader open but never read it
+    sleep 1;
+    kill TERM => $pid;
+    my $t0 = [ gettimeofday ];
+    my $done;
+    while (tv_interval($t0) < 10) {
+        $done = waitpid($pid, WNOHANG);
+        last if $done == $pid;
+        sleep 0.1;
+    }
+    is $done => $pid, "go-redis-setlock exited";
+    ok tv_interval($t0) < 10, "exited in " . tv_interval($t0) . " seconds";
+    kill KILL => $pid unless $done == $pid;
+};
+
+done_testing;
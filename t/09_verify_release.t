@@ -0,0 +1,52 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+# the unlock script finds another token, as if the lock was taken over
+my $server = stub_redis_server(
+    EVAL => sub { ":0\r\n" },
+);
+my $port = $server->port;
+
+subtest "token mismatch is only logged by default" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:$port",
+        "taken-over",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 0, "exit 0";
+};
+
+subtest "token mismatch fails with --verify-release" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:$port",
+        "--verify-release",
+        "taken-over",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111, "exit 111";
+};
+
+subtest "token mismatch fails with --strict" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:$port",
+        "--strict",
+        "taken-over",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111, "exit 111";
+};
+
+subtest "--strict keeps the exit code of a failed program" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:$port",
+        "--strict",
+        "taken-over",
+        "perl", "-e", "exit 3",
+    );
+    is $code => 3, "exit 3";
+};
+
+done_testing;
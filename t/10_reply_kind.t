@@ -0,0 +1,81 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+sub setlock_with_reply {
+    my ($reply, @options) = @_;
+    my $server = stub_redis_server(SET => sub { $reply });
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        @options,
+        "reply-kind",
+        "perl", "-e", "exit 0",
+    );
+    return $code, $elapsed;
+}
+
+subtest "status OK acquires" => sub {
+    my ($code) = setlock_with_reply("+OK\r\n", "-n");
+    is $code => 0;
+};
+
+subtest "nil is locked by another" => sub {
+    my ($code) = setlock_with_reply("\$-1\r\n", "-n");
+    is $code => 111;
+};
+
+subtest "error is an error, not locked by another" => sub {
+    my ($code, $elapsed) = setlock_with_reply("-OOM command not allowed\r\n", "-N");
+    is $code => 111;
+    ok $elapsed < 1, "not retried: elapsed seconds $elapsed < 1";
+    ($code) = setlock_with_reply("-OOM command not allowed\r\n", "-n", "-x");
+    is $code => 111, "even with -x";
+    ($code) = setlock_with_reply("-READONLY You can't write against a read only replica.\r\n", "-skip-if-locked");
+    is $code => 111, "even with -skip-if-locked";
+};
+
+subtest "nil with -x" => sub {
+    my ($code) = setlock_with_reply("\$-1\r\n", "-n", "-x");
+    is $code => 0;
+};
+
+subtest "ambiguous reply fails at once" => sub {
+    my ($code, $elapsed) = setlock_with_reply(":1\r\n");
+    is $code => 111;
+    ok $elapsed < 1, "elapsed seconds $elapsed < 1";
+};
+
+subtest "ambiguous reply is retried" => sub {
+    my ($code) = setlock_with_reply(":1\r\n", "-n", "--on-ambiguous-reply" => "retry");
+    is $code => 111;
+};
+
+subtest "ambiguous reply is unlocked before retrying" => sub {
+    my $unlocks = "t/reply_kind.$$";
+    unlink $unlocks;
+    my $server = stub_redis_server(
+        SET  => sub { ":1\r\n" },
+        EVAL => sub {
+            open my $fh, ">>", $unlocks or die $!;
+            print $fh "$_[3]\n" if $_[1] =~ /"del"/;
+            close $fh;
+            ":1\r\n";
+        },
+    );
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        "-N", "--wait-timeout" => "1200ms", "--on-ambiguous-reply" => "retry",
+        "reply-kind",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    open my $fh, "<", $unlocks or die $!;
+    my @unlocks = <$fh>;
+    close $fh;
+    unlink $unlocks;
+    cmp_ok scalar(@unlocks), ">=", 2, "unlocked each attempt";
+};
+
+done_testing;
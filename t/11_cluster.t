@@ -0,0 +1,66 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $owner = stub_redis_server();
+my $owner_port = $owner->port;
+my $moved = stub_redis_server(
+    SET  => sub { "-MOVED 3999 127.0.0.1:$owner_port\r\n" },
+    EVAL => sub { "-MOVED 3999 127.0.0.1:$owner_port\r\n" },
+);
+my $asked = stub_redis_server(
+    SET  => sub { "-ASK 3999 127.0.0.1:$owner_port\r\n" },
+);
+
+subtest "MOVED fails without --cluster" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $moved->port,
+        "-n",
+        "cluster-lock",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+};
+
+subtest "MOVED is followed with --cluster" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $moved->port,
+        "--cluster", "-n",
+        "cluster-lock",
+        "perl", "-e", "exit 7",
+    );
+    is $code => 7;
+};
+
+subtest "ASK is followed with --cluster" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $asked->port,
+        "--cluster", "-n",
+        "cluster-lock",
+        "perl", "-e", "exit 7",
+    );
+    is $code => 7;
+};
+
+subtest "WAIT goes to the node which served the SET" => sub {
+    my $replicated = stub_redis_server(WAIT => sub { ":1\r\n" });
+    my $replicated_port = $replicated->port;
+    for my $redirect (qw/ MOVED ASK /) {
+        my $seed = stub_redis_server(
+            SET  => sub { "-$redirect 3999 127.0.0.1:$replicated_port\r\n" },
+            EVAL => sub { "-$redirect 3999 127.0.0.1:$replicated_port\r\n" },
+            WAIT => sub { ":0\r\n" },
+        );
+        my ($code) = redis_setlock(
+            "--redis" => "127.0.0.1:" . $seed->port,
+            "--cluster", "-n", "--wait-replicas" => 1,
+            "cluster-lock",
+            "perl", "-e", "exit 7",
+        );
+        is $code => 7, "after $redirect";
+    }
+};
+
+done_testing;
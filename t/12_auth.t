@@ -0,0 +1,92 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+sub setlock_with_password {
+    my @options = @_;
+    my $authed;
+    my $server = stub_redis_server(
+        AUTH => sub {
+            $authed = $_[1] eq "secret";
+            $authed ? "+OK\r\n" : "-WRONGPASS invalid password\r\n";
+        },
+        SET => sub { $authed ? "+OK\r\n" : "-NOAUTH Authentication required.\r\n" },
+    );
+    return redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        @options,
+        "auth",
+        "perl", "-e", "exit 0",
+    );
+}
+
+subtest "-auth" => sub {
+    my ($code) = setlock_with_password("-auth" => "secret");
+    is $code => 0;
+};
+
+subtest "REDIS_PASSWORD" => sub {
+    local $ENV{REDIS_PASSWORD} = "secret";
+    my ($code) = setlock_with_password();
+    is $code => 0;
+};
+
+subtest "wrong password fails at once" => sub {
+    my ($code, $elapsed) = setlock_with_password("-auth" => "wrong");
+    is $code => 111;
+    ok $elapsed < 1, "elapsed seconds $elapsed < 1";
+};
+
+# the AUTH and SELECT sent for a -redis URL, logged by the server.
+my $log = "t/auth.$$";
+my $url_server = stub_redis_server(
+    AUTH => sub {
+        shift;
+        open my $fh, ">>", $log or die $!;
+        print $fh "AUTH @_\n";
+        close $fh;
+        "+OK\r\n";
+    },
+    SELECT => sub {
+        open my $fh, ">>", $log or die $!;
+        print $fh "SELECT $_[1]\n";
+        close $fh;
+        "+OK\r\n";
+    },
+);
+my $hostport = "127.0.0.1:" . $url_server->port;
+
+for my $case (
+    [ "redis://$hostport"               => [] ],
+    [ "redis://$hostport/"              => [] ],
+    [ "redis://$hostport/3"             => [ "SELECT 3" ] ],
+    [ "redis://user:secret\@$hostport"  => [ "AUTH user secret" ] ],
+    [ "redis://:secret\@$hostport"      => [ "AUTH secret" ] ],
+    [ "redis://secret\@$hostport"       => [ "AUTH secret" ] ],
+    [ "redis://user:p%40ss\@$hostport/2" => [ "AUTH user p\@ss", "SELECT 2" ] ],
+    [ [ "redis://:secret\@$hostport/2", "-auth" => "other", "-db" => 5 ] => [ "AUTH other", "SELECT 5" ] ],
+) {
+    my ($args, $expected) = @$case;
+    my @args = ref $args ? @$args : ($args);
+    subtest "-redis @args" => sub {
+        unlink $log;
+        my ($code) = redis_setlock("--redis" => @args, "auth", "perl", "-e", "exit 0");
+        is $code => 0;
+        my @sent;
+        if (open my $fh, "<", $log) {
+            chomp(@sent = <$fh>);
+        }
+        unlink $log;
+        is_deeply \@sent => $expected;
+    };
+}
+
+subtest "rediss:// connects by TLS" => sub {
+    my $out = `./go-redis-setlock --redis rediss://$hostport -n auth true 2>&1`;
+    is $? >> 8 => 111;
+    like $out => qr/TLS handshake with \Q$hostport\E/;
+};
+
+done_testing;
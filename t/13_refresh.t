@@ -0,0 +1,69 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use File::Temp qw/ tempfile /;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my (undef, $log) = tempfile(UNLINK => 1);
+my $server = stub_redis_server(
+    EVAL => sub {
+        if ($_[1] =~ /expire/) {
+            open my $fh, ">>", $log or die $!;
+            print $fh "$_[3] $_[5]\n";
+            close $fh;
+        }
+        ":1\r\n";
+    },
+);
+
+sub extended {
+    open my $fh, "<", $log or die $!;
+    my @lines = <$fh>;
+    return scalar @lines;
+}
+
+subtest "not refreshed by default" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        "--expires" => 1,
+        "refresh",
+        "perl", "-e", "sleep 2",
+    );
+    is $code => 0;
+    is extended() => 0;
+};
+
+subtest "-refresh" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        "--expires" => 1,
+        "--refresh",
+        "refresh",
+        "perl", "-e", "sleep 2",
+    );
+    is $code => 0;
+    cmp_ok extended(), ">=", 3, "extended every 0.5s";
+    open my $fh, "<", $log or die $!;
+    is scalar(<$fh>) => "refresh 1\n", "extended to -expires";
+};
+
+subtest "-keep -refresh stops refreshing when the program exited" => sub {
+    truncate $log, 0;
+    my $start = time;
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        "--expires" => 1,
+        "--refresh",
+        "--keep",
+        "refresh",
+        "perl", "-e", "sleep 1",
+    );
+    is $code => 0;
+    my $during = extended();
+    cmp_ok $during, ">=", 1, "extended while the program ran";
+    sleep 2;
+    is extended() => $during, "not extended after the program exited";
+};
+
+done_testing;
@@ -0,0 +1,35 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $server = stub_redis_server(SET => sub { "\$-1\r\n" });
+
+subtest "-wait-timeout" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $server->port,
+        "--expires" => 3600,
+        "--wait-timeout" => "1500ms",
+        "wait-timeout",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    ok 1 <= $elapsed && $elapsed < 2.5, "elapsed seconds $elapsed";
+};
+
+subtest "-wait-timeout with -shared" => sub {
+    my $exclusive = stub_redis_server(EVAL => sub { $_[1] =~ /"zadd"/ ? ":0\r\n" : ":1\r\n" });
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $exclusive->port,
+        "--expires" => 3600,
+        "--wait-timeout" => "1500ms",
+        "--shared",
+        "wait-timeout",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    ok 1 <= $elapsed && $elapsed < 2.5, "elapsed seconds $elapsed";
+};
+
+done_testing;
@@ -0,0 +1,29 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Time::HiRes qw/ gettimeofday tv_interval /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+
+for my $stream (qw/ STDOUT STDERR /) {
+    subtest "burst to $stream before exiting" => sub {
+        my $redirect = $stream eq "STDERR" ? "2>&1 >/dev/null" : "2>/dev/null";
+        for (1 .. 5) {
+            my $output = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} output perl -e 'print $stream "x" x 1_000_000; exit 0' $redirect`;
+            is length($output) => 1_000_000;
+        }
+    };
+}
+
+subtest "a background process holding stdout does not keep the lock" => sub {
+    my $t0 = [ gettimeofday ];
+    my $output = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} output sh -c 'sleep 8 & echo ran' 2>/dev/null`;
+    my $elapsed = tv_interval($t0);
+    is $? >> 8 => 0;
+    is $output => "ran\n";
+    ok $elapsed < 6, "exited in $elapsed seconds";
+};
+
+done_testing;
@@ -0,0 +1,45 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Test::SharedFork;
+use Time::HiRes qw/ sleep /;
+use t::Util qw/ redis_server redis_setlock /;
+
+my $redis_server = redis_server();
+my $port = $redis_server->conf->{port};
+my $prefix = join("-", time, $$, rand());
+
+sub setlock {
+    redis_setlock("--redis" => "127.0.0.1:$port", @_);
+}
+
+# one of the keys is held by another
+if (my $pid = fork()) {
+    sleep 0.5;
+    my ($code) = setlock("-n", "-keys" => "$prefix-a,$prefix-b", "perl", "-e", "exit 0");
+    is $code => 111, "could not lock all the keys";
+    ($code) = setlock("-n", "$prefix-a", "perl", "-e", "exit 0");
+    is $code => 0, "the key locked partially was released";
+    waitpid $pid, 0;
+}
+else {
+    setlock("$prefix-b", "perl", "-e", "sleep 2");
+    exit;
+}
+
+# overlapping sets in the different order never deadlock
+my @pids;
+for my $keys ("$prefix-c,$prefix-d", "$prefix-d,$prefix-c") {
+    my $pid = fork();
+    if ($pid == 0) {
+        my ($code, $elapsed) = setlock("-keys" => $keys, "perl", "-e", "sleep 1");
+        is $code => 0, "$keys locked";
+        ok $elapsed < 4, "$keys elapsed seconds $elapsed < 4";
+        exit;
+    }
+    push @pids, $pid;
+}
+waitpid $_, 0 for @pids;
+
+done_testing;
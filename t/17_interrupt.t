@@ -0,0 +1,34 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Time::HiRes qw/ sleep gettimeofday tv_interval /;
+use POSIX qw/ WNOHANG /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server(SET => sub { "\$-1\r\n" });
+
+subtest "signal while waiting for the lock" => sub {
+    my $pid = fork();
+    die "fork: $!" unless defined $pid;
+    if ($pid == 0) {
+        exec "./go-redis-setlock", "--redis" => "127.0.0.1:" . $server->port,
+            "interrupt", "perl", "-e", "exit 0";
+        die "exec: $!";
+    }
+    sleep 1;
+    kill TERM => $pid;
+    my $t0 = [ gettimeofday ];
+    my $done;
+    while (tv_interval($t0) < 3) {
+        $done = waitpid($pid, WNOHANG);
+        last if $done == $pid;
+        sleep 0.01;
+    }
+    is $done => $pid, "go-redis-setlock exited";
+    is $? >> 8 => 128 + POSIX::SIGTERM, "exit code";
+    ok tv_interval($t0) < 0.3, "exited in " . tv_interval($t0) . " seconds";
+    kill KILL => $pid unless $done == $pid;
+};
+
+done_testing;
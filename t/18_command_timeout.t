@@ -0,0 +1,37 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $server = stub_redis_server();
+
+sub setlock {
+    redis_setlock("--redis" => "127.0.0.1:" . $server->port, @_);
+}
+
+subtest "finishes in time" => sub {
+    my ($code, $elapsed) = setlock("--command-timeout" => "2s", "timeout", "perl", "-e", "exit 3");
+    is $code => 3;
+    ok $elapsed < 1, "elapsed seconds $elapsed < 1";
+};
+
+subtest "terminated by -command-timeout" => sub {
+    my ($code, $elapsed) = setlock("--command-timeout" => "1s", "timeout", "perl", "-e", "sleep 10");
+    is $code => 124;
+    ok 1 <= $elapsed && $elapsed < 2, "elapsed seconds $elapsed";
+};
+
+subtest "killed after -kill-timeout" => sub {
+    my ($code, $elapsed) = setlock(
+        "--command-timeout" => "1s",
+        "--kill-timeout" => "1s",
+        "--timeout-exit-code" => 100,
+        "timeout",
+        "perl", "-e", q{$SIG{TERM} = "IGNORE"; sleep 10},
+    );
+    is $code => 100;
+    ok 2 <= $elapsed && $elapsed < 3, "elapsed seconds $elapsed";
+};
+
+done_testing;
@@ -0,0 +1,40 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Net::EmptyPort qw/ empty_port /;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $master = stub_redis_server();
+my $master_port = $master->port;
+my $sentinel = stub_redis_server(
+    SENTINEL => sub {
+        $_[2] eq "mymaster"
+            ? "*2\r\n\$9\r\n127.0.0.1\r\n\$" . length($master_port) . "\r\n$master_port\r\n"
+            : "\$-1\r\n";
+    },
+    SET => sub { "-ERR not the master\r\n" },
+);
+my $down = empty_port();
+
+subtest "master from the sentinels" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:$down,127.0.0.1:" . $sentinel->port,
+        "--sentinel", "--master-name" => "mymaster", "-n",
+        "sentinel",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 0;
+};
+
+subtest "unknown master" => sub {
+    my ($code) = redis_setlock(
+        "--redis" => "127.0.0.1:" . $sentinel->port,
+        "--sentinel", "--master-name" => "unknown", "-n",
+        "sentinel",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+};
+
+done_testing;
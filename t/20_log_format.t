@@ -0,0 +1,31 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use JSON::PP qw/ decode_json /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server(SET => sub { "-OOM command not allowed\r\n" });
+my $port = $server->port;
+
+subtest "-log-format json" => sub {
+    my @lines = `./go-redis-setlock --redis 127.0.0.1:$port -n -log-format json log-format echo hello 2>&1 >/dev/null`;
+    ok scalar(@lines) > 0, "logged";
+    for my $line (@lines) {
+        my $entry = eval { decode_json($line) };
+        ok $entry, "JSON: $line" or next;
+        ok $entry->{time} && $entry->{level} && defined $entry->{msg}, "fields";
+    }
+    my ($set) = grep { $_->{msg} eq "could not lock log-format" } map { decode_json($_) } @lines;
+    is $set->{key} => "log-format";
+    is $set->{level} => "error";
+    like $set->{error} => qr/OOM/;
+};
+
+subtest "the command's output is untouched" => sub {
+    my $ok = stub_redis_server();
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $ok->port ]} -log-format json log-format echo hello 2>/dev/null`;
+    is $out => "hello\n";
+};
+
+done_testing;
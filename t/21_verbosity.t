@@ -0,0 +1,46 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $locked = stub_redis_server(SET => sub { "\$-1\r\n" });
+my $attempts = 0;
+my $busy = stub_redis_server(SET => sub { $attempts++ < 2 ? "\$-1\r\n" : "+OK\r\n" });
+
+subtest "-v" => sub {
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $busy->port ]} -v verbosity echo hello 2>&1 >/dev/null`;
+    is $? >> 8 => 0;
+    like $log => qr/waiting for lock verbosity held by another process, attempt 1, waited /;
+    like $log => qr/attempt 2, waited /;
+    like $log => qr/acquired lock verbosity, attempt 3, waited /;
+    like $log => qr/released lock verbosity/;
+};
+
+subtest "-q" => sub {
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $locked->port ]} -n -x -q -log-on always verbosity echo hello 2>&1 >/dev/null`;
+    is $? >> 8 => 0;
+    is $log => "", "silent when the lock is held with -x";
+
+    $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $locked->port ]} -n -q verbosity echo hello 2>&1 >/dev/null`;
+    is $? >> 8 => 111;
+    like $log => qr/verbosity: unable to lock/, "the failure is logged";
+
+    $log = `./go-redis-setlock --redis 127.0.0.1:1 -q -wait-timeout 1s verbosity echo hello 2>&1 >/dev/null`;
+    is $? >> 8 => 111;
+    like $log => qr/Redis server seems down/;
+};
+
+subtest "the command's output is untouched" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $busy->port ]} -q verbosity sh -c 'echo out; echo err >&2' 2>/dev/null`;
+    is $out => "out\n";
+    my $err = `./go-redis-setlock --redis 127.0.0.1:@{[ $busy->port ]} -q verbosity sh -c 'echo out; echo err >&2' 2>&1 >/dev/null`;
+    is $err => "err\n";
+};
+
+subtest "-v and -q" => sub {
+    system("./go-redis-setlock -v -q verbosity true 2>/dev/null");
+    is $? >> 8 => 2;
+};
+
+done_testing;
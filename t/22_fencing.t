@@ -0,0 +1,36 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server(INCR => sub { $_[1] eq "fencing:fence" ? ":42\r\n" : "-ERR unexpected key $_[1]\r\n" });
+my $port = $server->port;
+
+subtest "SETLOCK_FENCING_TOKEN" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -fencing fencing sh -c 'echo \$SETLOCK_FENCING_TOKEN \$SETLOCK_FENCE'`;
+    is $? >> 8 => 0;
+    is $out => "42 42\n";
+};
+
+subtest "-fencing-fd" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -fencing -fencing-fd 4 fencing sh -c 'cat <&4'`;
+    is $? >> 8 => 0;
+    is $out => "42\n";
+};
+
+subtest "INCR failed" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -fencing-key other fencing echo hello 2>&1`;
+    is $? >> 8 => 111;
+    like $out => qr/could not INCR fencing key other/;
+    unlike $out => qr/hello/, "the command is not run";
+};
+
+subtest "usage" => sub {
+    for my $args ("-fencing-fd 4 fencing true", "-fencing -fencing-fd 2 fencing true", "-fencing -fencing-key x fencing true") {
+        system("./go-redis-setlock $args 2>/dev/null");
+        is $? >> 8 => 2, $args;
+    }
+};
+
+done_testing;
@@ -0,0 +1,92 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Test::SharedFork;
+use Time::HiRes qw/ sleep /;
+use t::Util qw/ redis_server redis_setlock /;
+
+my $redis_server = redis_server();
+my $port = $redis_server->conf->{port};
+my $key = join("-", time, $$, rand());
+
+sub setlock {
+    redis_setlock("--redis" => "127.0.0.1:$port", @_);
+}
+
+# runs setlock with each of @runs ([delay, args...]) at once, returning
+# [code, elapsed] of each.
+sub run_all {
+    my @runs = @_;
+    my @pids;
+    for my $i (0 .. $#runs) {
+        my ($delay, @args) = @{ $runs[$i] };
+        my $pid = fork();
+        if ($pid == 0) {
+            sleep $delay;
+            my ($code, $elapsed) = setlock(@args);
+            open my $fh, ">", "$key.$i" or die $!;
+            print $fh "$code $elapsed\n";
+            close $fh;
+            exit;
+        }
+        push @pids, $pid;
+    }
+    waitpid $_, 0 for @pids;
+    my @results;
+    for my $i (0 .. $#runs) {
+        open my $fh, "<", "$key.$i" or die $!;
+        push @results, [ split / /, scalar <$fh> ];
+        close $fh;
+        unlink "$key.$i";
+    }
+    return @results;
+}
+
+subtest "readers run together" => sub {
+    my @r = run_all(
+        [ 0, "-shared", $key, "perl", "-e", "sleep 2" ],
+        [ 0, "-shared", $key, "perl", "-e", "sleep 2" ],
+        [ 0.5, "-shared", "-n", $key, "perl", "-e", "exit 0" ],
+    );
+    is $_->[0] => 0, "reader exited 0" for @r;
+    ok $r[0][1] < 3 && $r[1][1] < 3, "not serialized: $r[0][1] $r[1][1]";
+};
+
+subtest "a writer waits for the readers" => sub {
+    my @r = run_all(
+        [ 0, "-shared", $key, "perl", "-e", "sleep 2" ],
+        [ 0.5, "-n", $key, "perl", "-e", "exit 0" ],
+        [ 0.5, $key, "perl", "-e", "exit 0" ],
+    );
+    is $r[0][0] => 0;
+    is $r[1][0] => 111, "-n writer gave up";
+    is $r[2][0] => 0;
+    ok $r[2][1] > 1, "writer waited $r[2][1] seconds";
+};
+
+subtest "readers wait for a writer" => sub {
+    my @r = run_all(
+        [ 0, $key, "perl", "-e", "sleep 2" ],
+        [ 0.5, "-shared", "-n", $key, "perl", "-e", "exit 0" ],
+        [ 0.5, "-shared", "-n", "-x", $key, "perl", "-e", "exit 3" ],
+        [ 0.5, "-shared", $key, "perl", "-e", "exit 0" ],
+    );
+    is $r[0][0] => 0;
+    is $r[1][0] => 111, "-n reader gave up";
+    is $r[2][0] => 0, "-x reader exited zero";
+    is $r[3][0] => 0;
+    ok $r[3][1] > 1, "reader waited $r[3][1] seconds";
+};
+
+subtest "released by the last reader" => sub {
+    my ($code) = setlock("-n", $key, "perl", "-e", "exit 0");
+    is $code => 0;
+};
+
+subtest "usage" => sub {
+    my ($code) = setlock("-shared", "-keys", "a,b", "perl", "-e", "exit 0");
+    is $code => 2;
+};
+
+done_testing;
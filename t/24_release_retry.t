@@ -0,0 +1,47 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use POSIX ();
+use t::Util qw/ stub_redis_server /;
+
+my $drops = "t/release_retry.$$";
+
+# EVAL drops the connection the number of times written in $drops.
+sub dropping_server {
+    my $n = shift;
+    open my $fh, ">", $drops or die $!;
+    print $fh $n;
+    close $fh;
+    return stub_redis_server(EVAL => sub {
+        open my $fh, "+<", $drops or die $!;
+        my $left = <$fh>;
+        if ($left > 0) {
+            seek $fh, 0, 0;
+            print $fh $left - 1;
+            close $fh;
+            POSIX::_exit(0);
+        }
+        ":1\r\n";
+    });
+}
+
+subtest "reconnect and release" => sub {
+    my $server = dropping_server(1);
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -strict release-retry true 2>&1`;
+    is $? >> 8 => 0;
+    like $log => qr{connection lost on releasing the lock release-retry\. reconnecting \(1/3\)};
+    unlike $log => qr/failed/;
+};
+
+subtest "give up" => sub {
+    my $server = dropping_server(10);
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} release-retry true 2>&1`;
+    is $? >> 8 => 0, "the exit code of the command";
+    like $log => qr{reconnecting \(3/3\)};
+    like $log => qr/releasing the lock failed/;
+};
+
+unlink $drops;
+
+done_testing;
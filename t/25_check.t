@@ -0,0 +1,35 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $holder = "0123456789abcdef;web1;4242;1700000000";
+my $available = stub_redis_server();
+my $locked = stub_redis_server(
+    SET => sub { "\$-1\r\n" },
+    GET => sub { "\$@{[ length $holder ]}\r\n$holder\r\n" },
+    TTL => sub { ":30\r\n" },
+);
+
+subtest "available" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $available->port ]} -check check`;
+    is $? >> 8 => 0;
+    is $out => "check is available\n";
+};
+
+subtest "locked" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $locked->port ]} -check check`;
+    is $? >> 8 => 111;
+    like $out => qr/^check is locked by pid 4242 on web1 since .+ \(token 0123456789abcdef\), ttl 30s$/;
+
+    $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $locked->port ]} -check -x check`;
+    is $? >> 8 => 0, "-x";
+};
+
+subtest "the program is not run" => sub {
+    system("./go-redis-setlock -check check echo hello >/dev/null 2>&1");
+    is $? >> 8 => 2;
+};
+
+done_testing;
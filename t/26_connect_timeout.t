@@ -0,0 +1,34 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ redis_setlock /;
+
+# a non routable address, to which connecting never completes.
+my $blackhole = "10.255.255.1:6379";
+
+subtest "-n" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => $blackhole,
+        "--connect-timeout" => "1s",
+        "-n",
+        "connect-timeout",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    ok $elapsed < 3, "elapsed seconds $elapsed";
+};
+
+subtest "-N" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--redis" => $blackhole,
+        "--connect-timeout" => "500ms",
+        "--wait-timeout" => "2s",
+        "connect-timeout",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    ok $elapsed < 5, "elapsed seconds $elapsed";
+};
+
+done_testing;
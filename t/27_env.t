@@ -0,0 +1,44 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server redis_setlock /;
+
+my $server = stub_redis_server(SET => sub { "\$-1\r\n" });
+my $port = $server->port;
+
+subtest "REDIS_SETLOCK_REDIS and REDIS_SETLOCK_WAIT" => sub {
+    local $ENV{REDIS_SETLOCK_REDIS} = "127.0.0.1:$port";
+    local $ENV{REDIS_SETLOCK_WAIT} = "false";
+    my ($code, $elapsed) = redis_setlock("env", "perl", "-e", "exit 0");
+    is $code => 111, "gave up as -n";
+    ok $elapsed < 1, "elapsed seconds $elapsed";
+};
+
+subtest "the flags win" => sub {
+    local $ENV{REDIS_SETLOCK_REDIS} = "127.0.0.1:1";
+    local $ENV{REDIS_SETLOCK_WAIT} = "false";
+    local $ENV{REDIS_SETLOCK_WAIT_TIMEOUT} = "1s";
+    my ($code, $elapsed) = redis_setlock("--redis" => "127.0.0.1:$port", "-N", "env", "perl", "-e", "exit 0");
+    is $code => 111;
+    ok $elapsed >= 0.5, "waited by -N and REDIS_SETLOCK_WAIT_TIMEOUT: $elapsed";
+};
+
+subtest "invalid value" => sub {
+    local $ENV{REDIS_SETLOCK_EXPIRES} = "forever";
+    my $out = `./go-redis-setlock env true 2>&1`;
+    is $? >> 8 => 2;
+    like $out => qr/invalid REDIS_SETLOCK_EXPIRES/;
+};
+
+# each would turn the run into another mode, or confirm one.
+for my $var (qw/ RELEASE FORCE GC YES WHO CHECK LOCK_CHECK SELFTEST WATCH VERSION /) {
+    subtest "REDIS_SETLOCK_$var is ignored" => sub {
+        local $ENV{"REDIS_SETLOCK_$var"} = "true";
+        my $out = `./go-redis-setlock --redis 127.0.0.1:$port -n env echo ran 2>&1`;
+        is $? >> 8 => 111, "locking as usual";
+        unlike $out => qr/^ran$/m;
+    };
+}
+
+done_testing;
@@ -0,0 +1,41 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server(
+    SET  => sub { $_[1] =~ /^team1:/ ? "+OK\r\n" : "-ERR unexpected key $_[1]\r\n" },
+    EVAL => sub { $_[3] =~ /^team1:/ ? ":1\r\n" : ":0\r\n" },
+    GET  => sub { $_[1] =~ /^team1:/ ? "\$5\r\ntoken\r\n" : "\$-1\r\n" },
+    TTL  => sub { ":10\r\n" },
+);
+my @redis = ("--redis", "127.0.0.1:" . $server->port);
+
+subtest "locked and released with the prefix" => sub {
+    system("./go-redis-setlock", @redis, "-n", "-strict", "-prefix", "team1:", "prefix", "true");
+    is $? >> 8 => 0;
+};
+
+subtest "-keys" => sub {
+    system("./go-redis-setlock", @redis, "-n", "-strict", "-prefix", "team1:", "-keys", "a,b", "true");
+    is $? >> 8 => 0;
+};
+
+subtest "REDIS_SETLOCK_PREFIX" => sub {
+    local $ENV{REDIS_SETLOCK_PREFIX} = "team1:";
+    system("./go-redis-setlock", @redis, "-n", "-strict", "prefix", "true");
+    is $? >> 8 => 0;
+};
+
+subtest "-who" => sub {
+    my $out = `./go-redis-setlock @redis -prefix team1: -who prefix`;
+    like $out => qr/^team1:prefix is locked by token token/;
+};
+
+subtest "without the prefix" => sub {
+    system("./go-redis-setlock @redis -n prefix true 2>/dev/null");
+    is $? >> 8 => 111;
+};
+
+done_testing;
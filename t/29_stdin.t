@@ -0,0 +1,32 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+my $setlock = "./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]}";
+
+subtest "stdin is passed" => sub {
+    my $out = `echo hello | $setlock stdin cat`;
+    is $out => "hello\n";
+};
+
+subtest "the command closed stdin" => sub {
+    my $err = `perl -e 'print "x" x 1000000' | $setlock stdin perl -e 'close STDIN; sleep 1' 2>&1`;
+    is $? >> 8 => 0;
+    is $err => "", "no error logged";
+};
+
+subtest "-no-stdin" => sub {
+    my $out = `echo hello | $setlock -no-stdin stdin cat`;
+    is $? >> 8 => 0;
+    is $out => "";
+};
+
+subtest "-no-stdin and -stdin-line" => sub {
+    system("$setlock -no-stdin -stdin-line hi stdin cat 2>/dev/null");
+    is $? >> 8 => 2;
+};
+
+done_testing;
@@ -0,0 +1,46 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $holder = "0123456789abcdef;web1;4242;1700000000";
+my $locked = stub_redis_server(
+    SET => sub { "\$-1\r\n" },
+    GET => sub { "\$@{[ length $holder ]}\r\n$holder\r\n" },
+);
+my $available = stub_redis_server();
+
+sub setlock {
+    my ($server, @args) = @_;
+    # -on-locked takes a program without arguments, so a script is used.
+    my $script = "t/on_locked.$$.sh";
+    open my $fh, ">", $script or die $!;
+    print $fh qq{#!/bin/sh\necho "on-locked \$1 \$SETLOCK_HOLDER_HOST \$SETLOCK_HOLDER_PID \$SETLOCK_HOLDER_TIME"\n};
+    close $fh;
+    chmod 0755, $script;
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -on-locked $script @args 2>/dev/null`;
+    my $code = $? >> 8;
+    unlink $script;
+    return ($code, $out);
+}
+
+subtest "-x" => sub {
+    my ($code, $out) = setlock($locked, "-n", "-x", "on-locked", "echo", "hello");
+    is $code => 0;
+    is $out => "on-locked on-locked web1 4242 1700000000\n";
+};
+
+subtest "-X" => sub {
+    my ($code, $out) = setlock($locked, "-n", "on-locked", "echo", "hello");
+    is $code => 111;
+    is $out => "on-locked on-locked web1 4242 1700000000\n";
+};
+
+subtest "not run when locked" => sub {
+    my ($code, $out) = setlock($available, "-n", "on-locked", "echo", "hello");
+    is $code => 0;
+    is $out => "hello\n";
+};
+
+done_testing;
@@ -0,0 +1,24 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+subtest "the script cached" => sub {
+    my $server = stub_redis_server(
+        EVALSHA => sub { $_[1] =~ /^[0-9a-f]{40}$/ ? ":1\r\n" : "-ERR bad sha\r\n" },
+        EVAL    => sub { "-ERR EVAL is not expected\r\n" },
+    );
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -strict evalsha true 2>&1`;
+    is $? >> 8 => 0;
+    is $log => "", "released by EVALSHA";
+};
+
+subtest "NOSCRIPT falls back to EVAL" => sub {
+    my $server = stub_redis_server(EVAL => sub { $_[1] =~ /redis\.call/ ? ":1\r\n" : "-ERR no script\r\n" });
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -strict evalsha true 2>&1`;
+    is $? >> 8 => 0;
+    is $log => "";
+};
+
+done_testing;
@@ -0,0 +1,58 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $holder = "0123456789abcdef;web1;4242;1700000000";
+my %locked = (
+    GET => sub { "\$@{[ length $holder ]}\r\n$holder\r\n" },
+    TTL => sub { ":30\r\n" },
+    DEL => sub { ":1\r\n" },
+);
+my $locked = stub_redis_server(%locked);
+my $dry = stub_redis_server(%locked, DEL => sub { "-ERR DEL is not expected\r\n" }, EVAL => sub { "-ERR EVAL is not expected\r\n" });
+my $unlocked = stub_redis_server(GET => sub { "\$-1\r\n" });
+
+sub release {
+    my ($server, @args) = @_;
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -release @args release 2>&1`;
+    return ($? >> 8, $out);
+}
+
+subtest "-force" => sub {
+    my ($code, $out) = release($locked, "-force");
+    is $code => 0;
+    like $out => qr/^release is locked by pid 4242 on web1 .+\nremoved release\n\z/;
+};
+
+subtest "-token" => sub {
+    my ($code, $out) = release($locked, "-token", "0123456789abcdef");
+    is $code => 0;
+    like $out => qr/removed release/;
+
+    ($code, $out) = release($locked, "-token", "fedcba9876543210");
+    is $code => 1;
+    like $out => qr/release is not held by token fedcba9876543210/;
+};
+
+subtest "-dry-run" => sub {
+    my ($code, $out) = release($dry, "-force", "-dry-run");
+    is $code => 0;
+    like $out => qr/would remove release/;
+};
+
+subtest "not locked" => sub {
+    my ($code, $out) = release($unlocked, "-force");
+    is $code => 1;
+    like $out => qr/release is not locked/;
+};
+
+subtest "usage" => sub {
+    my ($code) = release($locked);
+    is $code => 2, "neither -token nor -force";
+    ($code) = release($locked, "-force", "-token", "x");
+    is $code => 2, "both -token and -force";
+};
+
+done_testing;
@@ -0,0 +1,51 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Time::HiRes qw/ sleep /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+my $file = "t/process_group.$$";
+
+# the grandchild, run in the background by a shell, tells when it started
+# and when it got SIGTERM.
+my $grandchild = q{
+    my $file = shift;
+    $SIG{TERM} = sub { open my $fh, ">", "$file.term"; exit };
+    open my $fh, ">", "$file.started";
+    close $fh;
+    sleep 30;
+};
+
+for my $stdin ("/dev/null", "pipe") {
+    subtest "the children of the command get the signal, stdin $stdin" => sub {
+        unlink "$file.started", "$file.term";
+        pipe my $r, my $w or die $!;
+        my $pid = fork();
+        if ($pid == 0) {
+            if ($stdin eq "pipe") {
+                open STDIN, "<&", $r or die $!;
+            }
+            else {
+                open STDIN, "<", "/dev/null" or die $!;
+            }
+            exec "./go-redis-setlock", "--redis", "127.0.0.1:" . $server->port, "process-group",
+                "sh", "-c", '"$@" & wait', "sh", $^X, "-e", $grandchild, $file;
+        }
+        close $r;
+        sleep 0.1 until -e "$file.started";
+        kill TERM => $pid;
+        waitpid $pid, 0;
+        is $? >> 8 => 143, "exited by SIGTERM";
+        for (1 .. 20) {
+            last if -e "$file.term";
+            sleep 0.1;
+        }
+        ok -e "$file.term", "the grandchild got SIGTERM";
+        close $w;
+        unlink "$file.started", "$file.term";
+    };
+}
+
+done_testing;
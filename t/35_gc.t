@@ -0,0 +1,71 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+sub bulk { defined $_[0] ? "\$" . length($_[0]) . "\r\n$_[0]\r\n" : "\$-1\r\n" }
+
+my $old = time - 7200;
+my %values = (
+    "job*:old"     => "t0ken;host1;123;$old",
+    "job*:new"     => "t1ken;host1;124;" . time,
+    "job*:runs"    => "3",
+    "job*:legacy"  => "t2ken",
+);
+my %handlers = (
+    SCAN => sub {
+        # the handlers run in the server process, so the pattern is checked here.
+        return "-ERR unexpected MATCH $_[3]\r\n" if $_[3] ne 'job\*:*';
+        my @keys = (sort(keys %values), "job*:readers");
+        "*2\r\n" . bulk("0") . "*" . scalar(@keys) . "\r\n" . join("", map { bulk($_) } @keys);
+    },
+    GET => sub {
+        return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" if $_[1] eq "job*:readers";
+        bulk($values{$_[1]});
+    },
+    TTL => sub { ":100\r\n" },
+);
+my $server = stub_redis_server(%handlers);
+my $port = $server->port;
+
+subtest "only the locks older than -older-than" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -gc -prefix 'job*:' -older-than 1h`;
+    is $? >> 8 => 0, "the prefix is escaped in MATCH";
+    like $out => qr/^would remove job\*:old held by token t0ken \(pid 123 on host1\), ttl 100s \(age 2h0m\d+s\)$/m;
+    unlike $out => qr/job\*:(new|runs|legacy|readers)/, "not the new locks nor the other keys";
+};
+
+subtest "-yes" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -gc -prefix 'job*:' -older-than 1h -yes`;
+    is $? >> 8 => 0;
+    like $out => qr/^removed job\*:old \(age 2h0m\d+s\)$/m;
+    is scalar(() = $out =~ /removed/g) => 1;
+};
+
+subtest "nothing to remove" => sub {
+    for my $yes ("", "-yes") {
+        my $out = `./go-redis-setlock --redis 127.0.0.1:$port -gc -prefix 'job*:' -older-than 3h $yes`;
+        is $? >> 8 => 1, "exits 1 with '$yes'";
+        is $out => "";
+    }
+};
+
+subtest "a removal failed" => sub {
+    my $failing = stub_redis_server(%handlers, EVAL => sub { "-ERR something went wrong\r\n" });
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $failing->port ]} -gc -prefix 'job*:' -older-than 1h -yes 2>&1`;
+    is $? >> 8 => 111;
+    like $out => qr/could not remove job\*:old: .*something went wrong/;
+
+    $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $failing->port ]} -gc -prefix 'job*:' -older-than 1h 2>&1`;
+    is $? >> 8 => 0, "a dry run does not remove";
+};
+
+subtest "SCAN failed" => sub {
+    my $failing = stub_redis_server(%handlers, SCAN => sub { "-ERR something went wrong\r\n" });
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $failing->port ]} -gc -prefix 'job*:' -older-than 1h 2>&1`;
+    is $? >> 8 => 111;
+    like $out => qr/SCAN failed/;
+};
+
+done_testing;
@@ -0,0 +1,28 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+for my $case (
+    [ ":-2\r\n"  => 0,   "not locked" ],
+    [ ":42\r\n"  => 42,  "the TTL" ],
+    [ ":100\r\n" => 100, "the TTL at the limit" ],
+    [ ":500\r\n" => 100, "clamped" ],
+    [ ":-1\r\n"  => 101, "no TTL, told from the clamped one" ],
+) {
+    my ($reply, $expected, $name) = @$case;
+    my $server = stub_redis_server(TTL => sub { $reply });
+    system "./go-redis-setlock", "--redis", "127.0.0.1:" . $server->port, "-lock-check", "lock-check";
+    is $? >> 8 => $expected, $name;
+}
+
+subtest "errors exit 111, which is never a TTL" => sub {
+    my $server = stub_redis_server(TTL => sub { "-ERR something wrong\r\n" });
+    system "./go-redis-setlock", "--redis", "127.0.0.1:" . $server->port, "-lock-check", "lock-check";
+    is $? >> 8 => 111, "TTL failed";
+    system "./go-redis-setlock", "--redis", "127.0.0.1:1", "-n", "-lock-check", "lock-check";
+    is $? >> 8 => 111, "the redis-server is down";
+};
+
+done_testing;
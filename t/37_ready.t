@@ -0,0 +1,21 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+my $file = "t/ready.$$";
+
+subtest "-ready-fd is written by the time go-redis-setlock exits" => sub {
+    unlink $file;
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -ready-pattern '^up\$' -ready-fd 3 ready sh -c 'echo starting; echo up; exit 0' 3>$file 2>/dev/null`;
+    is $? >> 8 => 0;
+    is $out => "starting\nup\n", "the output is forwarded as is";
+    open my $fh, "<", $file or die $!;
+    is do { local $/; <$fh> } => "ready\n";
+    close $fh;
+    unlink $file;
+};
+
+done_testing;
@@ -0,0 +1,45 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $locked = stub_redis_server(SET => sub { "\$-1\r\n" });
+my $free = stub_redis_server();
+my $file = "t/skip_if_locked.$$";
+my $result_file = "t/skip_if_locked.result.$$";
+
+sub result {
+    my $file = shift || $file;
+    open my $fh, "<", $file or return;
+    my $result = do { local $/; <$fh> };
+    close $fh;
+    unlink $file;
+    return $result;
+}
+
+subtest "skipped" => sub {
+    my $log = `./go-redis-setlock --redis 127.0.0.1:@{[ $locked->port ]} -skip-if-locked -q -exit-code-file $file -result-file $result_file skip echo ran 2>&1`;
+    is $? >> 8 => 0, "exits zero";
+    like $log => qr/skipped: skip is already locked by another process/, "logged even with -q";
+    unlike $log => qr/ran/, "the command did not run";
+    is result() => "0", "-exit-code-file has only the exit code";
+    is result($result_file) => "skipped", "-result-file tells it was skipped";
+};
+
+subtest "ran" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $free->port ]} -skip-if-locked -q -exit-code-file $file -result-file $result_file skip echo ran 2>&1`;
+    is $? >> 8 => 0;
+    is $out => "ran\n";
+    is result() => "0", "-exit-code-file has the exit code";
+    is result($result_file) => "ran";
+};
+
+subtest "not locked with -x" => sub {
+    `./go-redis-setlock --redis 127.0.0.1:@{[ $locked->port ]} -n -x -q -exit-code-file $file -result-file $result_file skip echo ran 2>&1`;
+    is $? >> 8 => 0;
+    is result() => "0";
+    is result($result_file) => "failed", "told from a run";
+};
+
+done_testing;
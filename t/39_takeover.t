@@ -0,0 +1,51 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Sys::Hostname qw/ hostname /;
+use t::Util qw/ stub_redis_server /;
+
+# a pid which does not exist any more.
+my $dead = fork();
+POSIX::_exit(0) if $dead == 0;
+waitpid $dead, 0;
+
+sub setlock_held_by {
+    my $holder = shift;
+    my $server = stub_redis_server(
+        SET  => sub { "\$-1\r\n" },
+        GET  => sub { "\$" . length($holder) . "\r\n$holder\r\n" },
+        EVAL => sub {
+            return ":1\r\n" if $_[1] !~ /"set"/;    # unlock
+            $_[4] eq $holder ? ":1\r\n" : ":0\r\n";
+        },
+    );
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -n -takeover-dead-holder takeover echo ran 2>&1`;
+    return $? >> 8, $out;
+}
+
+subtest "a dead holder on this host" => sub {
+    my ($code, $out) = setlock_held_by("t0ken;" . hostname() . ";$dead;" . time);
+    is $code => 0;
+    like $out => qr/took over lock takeover from pid $dead on /;
+    like $out => qr/^ran$/m;
+};
+
+subtest "a live holder on this host" => sub {
+    my ($code, $out) = setlock_held_by("t0ken;" . hostname() . ";$$;" . time);
+    is $code => 111;
+    unlike $out => qr/ran/;
+};
+
+subtest "a holder on another host" => sub {
+    my ($code, $out) = setlock_held_by("t0ken;another-host.example;$dead;" . time);
+    is $code => 111;
+    unlike $out => qr/ran/;
+};
+
+subtest "a lock without the holder" => sub {
+    my ($code, $out) = setlock_held_by("t0ken");
+    is $code => 111;
+};
+
+done_testing;
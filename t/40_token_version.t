@@ -0,0 +1,43 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+# the binary is built by make, which sets the commit by -ldflags.
+subtest "-token-include-version stores the version and the commit in the lock" => sub {
+    my $server = stub_redis_server(
+        SET => sub {
+            $_[2] =~ /^[0-9a-f]+;[^;]*;\d+;\d+;0\.0\.1\+[0-9a-f]+(-dirty)?$/
+                ? "+OK\r\n" : "-ERR unexpected value $_[2]\r\n";
+        },
+    );
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -token-include-version version echo ran 2>&1`;
+    is $? >> 8 => 0;
+    like $out => qr/^ran$/m;
+};
+
+subtest "without -token-include-version" => sub {
+    my $server = stub_redis_server(
+        SET => sub {
+            $_[2] =~ /^[0-9a-f]+;[^;]*;\d+;\d+$/
+                ? "+OK\r\n" : "-ERR unexpected value $_[2]\r\n";
+        },
+    );
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} version echo ran 2>&1`;
+    is $? >> 8 => 0;
+    like $out => qr/^ran$/m;
+};
+
+subtest "-who prints the version" => sub {
+    my $holder = "t0ken;web01;12345;" . time . ";0.0.1+0123456789ab";
+    my $server = stub_redis_server(
+        GET => sub { "\$" . length($holder) . "\r\n$holder\r\n" },
+        TTL => sub { ":60\r\n" },
+    );
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -who version 2>&1`;
+    is $? >> 8 => 0;
+    like $out => qr/^version is locked by pid 12345 on web01 since \S+ \(token t0ken, version 0\.0\.1\+0123456789ab\), ttl 60s$/m;
+};
+
+done_testing;
@@ -0,0 +1,39 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server(
+    SET => sub { "-ERR EX $_[4]\r\n" },
+);
+my $port = $server->port;
+
+sub setlock {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -n @_ ttl echo ran 2>&1`;
+    return $? >> 8, $out;
+}
+
+subtest "EX is -command-timeout, the time to kill and -ttl-margin" => sub {
+    my ($code, $out) = setlock("-ttl-from-timeout -command-timeout 5s -kill-timeout 2s -ttl-margin 2500ms");
+    like $out => qr/ERR EX 10\b/;
+    ($code, $out) = setlock("-ttl-from-timeout -command-timeout 5s");
+    like $out => qr/ERR EX 75\b/, "kill after 10s, with the margin of 1m";
+};
+
+subtest "usage errors" => sub {
+    for my $args (
+        "-ttl-from-timeout",
+        "-ttl-from-timeout -command-timeout 5s -expires 10",
+        "-ttl-from-timeout -command-timeout 5s -ttl-margin -1s",
+    ) {
+        my ($code, $out) = setlock($args);
+        is $code => 2, $args;
+        unlike $out => qr/ran/;
+    }
+    local $ENV{REDIS_SETLOCK_EXPIRES} = 10;
+    my ($code, $out) = setlock("-ttl-from-timeout -command-timeout 5s");
+    is $code => 2, "REDIS_SETLOCK_EXPIRES";
+};
+
+done_testing;
@@ -0,0 +1,36 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+my $port = $server->port;
+
+subtest "-max-restarts counts the restarts" => sub {
+    my $runs = "t/watch.$$";
+    unlink $runs;
+    my $start = time;
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -watch -watch-interval 0 -max-restarts 2 watch sh -c 'echo run >> $runs; exit 1' 2>&1`;
+    my $code = $? >> 8;
+    my @runs;
+    if (open my $fh, "<", $runs) {
+        @runs = <$fh>;
+        close $fh;
+    }
+    unlink $runs;
+    is $code => 1, "the exit code of the command";
+    is scalar(@runs) => 3, "ran once and restarted twice";
+    like $out => qr/backing off to 500ms/, "backs off even from -watch-interval 0";
+    like $out => qr/command failed 3 times in a row after 2 restarts, giving up -watch/;
+    ok time - $start < 10;
+};
+
+subtest "usage errors" => sub {
+    for my $args ("-watch-interval -1s", "-watch-backoff-max -1s", "-max-restarts -1") {
+        my $out = `./go-redis-setlock --redis 127.0.0.1:$port -watch $args watch true 2>&1`;
+        is $? >> 8 => 2, $args;
+    }
+};
+
+done_testing;
@@ -0,0 +1,34 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Time::HiRes qw/ gettimeofday tv_interval /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server(
+    EXISTS => sub { $_[1] eq "maintenance" ? ":1\r\n" : ":0\r\n" },
+);
+my $port = $server->port;
+
+subtest "-wait-timeout bounds the wait" => sub {
+    my $start = [gettimeofday];
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -N -wait-timeout 1s -wait-key-absent maintenance absent echo ran 2>&1`;
+    my $elapsed = tv_interval($start);
+    is $? >> 8 => 112;
+    like $out => qr/maintenance still exists/;
+    unlike $out => qr/ran/;
+    ok $elapsed < 5, "elapsed $elapsed < 5, not -expires";
+};
+
+subtest "-n gives up at once" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -n -wait-key-absent maintenance absent echo ran 2>&1`;
+    is $? >> 8 => 112;
+};
+
+subtest "the key is absent" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -N -wait-timeout 1s -wait-key-absent another absent echo ran 2>&1`;
+    is $? >> 8 => 0;
+    like $out => qr/^ran$/m;
+};
+
+done_testing;
@@ -0,0 +1,26 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+# the success marker must never be set: SET of it is an error.
+my $server = stub_redis_server(
+    SET => sub { $_[1] eq "done" ? "-ERR the marker was set\r\n" : "+OK\r\n" },
+);
+my $port = $server->port;
+
+subtest "a program which can not be run" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -set-success done start /nonexistent 2>&1`;
+    is $? >> 8 => 111;
+    like $out => qr/nonexistent/;
+    unlike $out => qr/the marker was set/;
+};
+
+subtest "-command-timeout" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -command-timeout 100ms start /nonexistent 2>&1`;
+    is $? >> 8 => 111;
+    unlike $out => qr/panic/;
+};
+
+done_testing;
@@ -0,0 +1,69 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $log = "t/rollback_keep.$$";
+
+# a server which logs the unlocks to $log. It counts 2 runs for -max-runs.
+sub unlock_logging_server {
+    return stub_redis_server(
+        EVAL => sub {
+            return ":2\r\n" if $_[1] =~ /"incr"/;
+            if ($_[1] =~ /"del"/) {
+                open my $fh, ">>", $log or die $!;
+                print $fh "unlock $_[3]\n";
+                close $fh;
+            }
+            ":1\r\n";
+        },
+        @_,
+    );
+}
+
+sub unlocks {
+    open my $fh, "<", $log or return ();
+    my @unlocks = <$fh>;
+    close $fh;
+    unlink $log;
+    return @unlocks;
+}
+
+subtest "-require-ttl refused the run" => sub {
+    unlink $log;
+    my $server = unlock_logging_server(PTTL => sub { ":1000\r\n" });
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -keep -require-ttl 60 rollback echo ran 2>&1`;
+    is $? >> 8 => 112;
+    unlike $out => qr/ran/;
+    is_deeply [ unlocks() ] => [ "unlock rollback\n" ], "unlocked even with -keep";
+};
+
+subtest "-max-runs refused the run" => sub {
+    unlink $log;
+    my $server = unlock_logging_server();
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -keep -max-runs 1 rollback echo ran 2>&1`;
+    is $? >> 8 => 113;
+    unlike $out => qr/ran$/m;
+    is_deeply [ unlocks() ] => [ "unlock rollback\n" ], "unlocked even with -keep";
+};
+
+subtest "INCR of -fencing failed" => sub {
+    unlink $log;
+    my $server = unlock_logging_server(INCR => sub { "-ERR fencing is broken\r\n" });
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -keep -fencing rollback echo ran 2>&1`;
+    is $? >> 8 => 111;
+    unlike $out => qr/^ran$/m;
+    is_deeply [ unlocks() ] => [ "unlock rollback\n" ], "unlocked even with -keep";
+};
+
+subtest "-keep keeps the lock of a program which ran" => sub {
+    unlink $log;
+    my $server = unlock_logging_server();
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} -keep rollback echo ran 2>&1`;
+    is $? >> 8 => 0;
+    like $out => qr/^ran$/m;
+    is_deeply [ unlocks() ] => [];
+};
+
+done_testing;
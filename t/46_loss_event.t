@@ -0,0 +1,53 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use File::Temp qw/ tempfile /;
+use t::Util qw/ stub_redis_server /;
+
+# the lock is lost: neither extended nor released.
+my $server = stub_redis_server(EVAL => sub { ":0\r\n" });
+my $port = $server->port;
+
+sub events {
+    my $file = shift;
+    open my $fh, "<", $file or return ();
+    my @lines = <$fh>;
+    close $fh;
+    return @lines;
+}
+
+subtest "lost on refresh" => sub {
+    my (undef, $file) = tempfile(UNLINK => 1);
+    my $start = time;
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -expires 1 -refresh -emit-loss-event $file -signal-on-loss TERM loss sleep 5 2>&1`;
+    my $code = $? >> 8;
+    ok time - $start < 4, "the command was signalled";
+    isnt $code => 0;
+    like $out => qr/sending terminated to the command as the lock loss was lost/i;
+    my @events = events($file);
+    is scalar(@events) => 1, "once, not again on release";
+    like $events[0] => qr/^\{"event":"lock_lost","key":"loss","token":"[0-9a-f]+","reason":"lost on refresh","acquired_at":"[^"]+","lost_at":"[^"]+","held_ms":\d+\}$/;
+};
+
+subtest "lost before release" => sub {
+    my (undef, $file) = tempfile(UNLINK => 1);
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -emit-loss-event $file loss true 2>&1`;
+    my @events = events($file);
+    is scalar(@events) => 1;
+    like $events[0] => qr/"reason":"expired or taken over before release"/;
+};
+
+subtest "to stderr" => sub {
+    my $out = `./go-redis-setlock --redis 127.0.0.1:$port -emit-loss-event - loss true 2>&1 >/dev/null`;
+    like $out => qr/^\{"event":"lock_lost",.*\}$/m;
+};
+
+subtest "usage errors" => sub {
+    for my $args ("-refresh -signal-on-loss KILL", "-signal-on-loss TERM") {
+        `./go-redis-setlock --redis 127.0.0.1:$port $args loss true 2>&1`;
+        is $? >> 8 => 2, $args;
+    }
+};
+
+done_testing;
@@ -0,0 +1,30 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use t::Util qw/ stub_redis_server /;
+
+my $free = stub_redis_server();
+my $locked = stub_redis_server(SET => sub { "\$-1\r\n" });
+my $file = "t/exit_code_file.$$";
+
+sub exit_code_file {
+    open my $fh, "<", $file or return;
+    my $content = do { local $/; <$fh> };
+    close $fh;
+    unlink $file;
+    return $content;
+}
+
+for my $case (
+    [ "the exit code of the program" => $free,   "-n",           3 ],
+    [ "the lock failed"              => $locked, "-n",           111 ],
+    [ "skipped"                      => $locked, "-skip-if-locked", 0 ],
+) {
+    my ($name, $server, $option, $expected) = @$case;
+    `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} $option -q -exit-code-file $file code sh -c 'exit 3' 2>&1`;
+    is $? >> 8 => $expected, "$name: exit code";
+    is exit_code_file() => $expected, "$name: only the integer in the file";
+}
+
+done_testing;
@@ -0,0 +1,49 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use JSON::PP qw/ decode_json /;
+use MIME::Base64 qw/ encode_base64 /;
+use t::Util qw/ stub_redis_server /;
+
+my $server = stub_redis_server();
+
+sub wrapped {
+    my $program = shift;
+    my $out = `./go-redis-setlock --redis 127.0.0.1:@{[ $server->port ]} --wrap-output-json wrap perl -e \Q$program\E 2>/dev/null`;
+    return $? >> 8, [ map { decode_json($_) } split /\n/, $out ];
+}
+
+my @cases = (
+    [ "a line"            => 'print "hello\n"'
+        => [ { stream => "stdout", line => "hello" } ] ],
+    [ "stderr"            => 'print STDERR "oops\n"'
+        => [ { stream => "stderr", line => "oops" } ] ],
+    [ "a partial line"    => 'print "a\nb"'
+        => [ { stream => "stdout", line => "a" }, { stream => "stdout", line => "b" } ] ],
+    [ "UTF-8"             => 'print "\xe3\x81\x82\n"'
+        => [ { stream => "stdout", line => "\x{3042}" } ] ],
+    [ "not UTF-8"         => 'print "\xff\xfe\x00x\n"'
+        => [ { stream => "stdout", line => encode_base64("\xff\xfe\x00x", ""), encoding => "base64" } ] ],
+);
+
+for my $case (@cases) {
+    my ($name, $program, $expected) = @$case;
+    subtest $name => sub {
+        my ($code, $lines) = wrapped($program);
+        is $code => 0;
+        is scalar(@$lines) => scalar(@$expected), "number of lines";
+        for my $i (0 .. $#$expected) {
+            my $l = $lines->[$i];
+            like delete $l->{ts} => qr/^\d{4}-\d\d-\d\dT/, "ts of line $i";
+            is_deeply $l => $expected->[$i], "line $i";
+        }
+    };
+}
+
+subtest "the exit code is kept" => sub {
+    my ($code) = wrapped('print "bye\n"; exit 3');
+    is $code => 3;
+};
+
+done_testing;
@@ -0,0 +1,60 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Time::HiRes qw/ sleep gettimeofday tv_interval /;
+use POSIX qw/ WNOHANG /;
+use t::Util qw/ redis_setlock /;
+
+subtest "acquired" => sub {
+    my $out = `./go-redis-setlock --acquire-command true --release-command 'echo released \$SETLOCK_EXIT_CODE' external sh -c 'echo ran; exit 3' 2>&1`;
+    is $? >> 8 => 3;
+    like $out => qr/^ran\nreleased 3$/m;
+};
+
+subtest "-wait-timeout" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--acquire-command" => "false",
+        "--wait-timeout" => "1500ms",
+        "external",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    ok 1 <= $elapsed && $elapsed < 2.5, "elapsed seconds $elapsed";
+};
+
+subtest "-n" => sub {
+    my ($code, $elapsed) = redis_setlock(
+        "--acquire-command" => "false",
+        "-n",
+        "external",
+        "perl", "-e", "exit 0",
+    );
+    is $code => 111;
+    ok $elapsed < 0.5, "elapsed seconds $elapsed";
+};
+
+subtest "signal while waiting for the lock" => sub {
+    my $pid = fork();
+    die "fork: $!" unless defined $pid;
+    if ($pid == 0) {
+        exec "./go-redis-setlock", "--acquire-command" => "false",
+            "external", "perl", "-e", "exit 0";
+        die "exec: $!";
+    }
+    sleep 1;
+    kill TERM => $pid;
+    my $t0 = [ gettimeofday ];
+    my $done;
+    while (tv_interval($t0) < 3) {
+        $done = waitpid($pid, WNOHANG);
+        last if $done == $pid;
+        sleep 0.01;
+    }
+    is $done => $pid, "go-redis-setlock exited";
+    is $? >> 8 => 128 + POSIX::SIGTERM, "exit code";
+    ok tv_interval($t0) < 0.3, "exited in " . tv_interval($t0) . " seconds";
+    kill KILL => $pid unless $done == $pid;
+};
+
+done_testing;
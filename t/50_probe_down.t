@@ -0,0 +1,33 @@
+# -*- mode:perl -*-
+use strict;
+use warnings;
+use Test::More;
+use Net::EmptyPort qw/ empty_port /;
+use t::Util qw/ redis_setlock /;
+
+# nothing listens on the port, so the redis-server is down.
+my $down = "127.0.0.1:" . empty_port();
+
+# the modes which only look at the lock try once, instead of waiting for
+# the redis-server for -expires.
+for my $args (
+    [ "-check", "probe" ],
+    [ "-who", "probe" ],
+    [ "-release", "-force", "probe" ],
+    [ "-lock-check", "probe" ],
+    [ "-gc", "-prefix" => "probe:", "-older-than" => "1h" ],
+) {
+    subtest "@$args" => sub {
+        my ($code, $elapsed) = redis_setlock("--redis" => $down, "--expires" => 3600, @$args);
+        is $code => 111;
+        ok $elapsed < 1, "elapsed seconds $elapsed";
+    };
+}
+
+subtest "-who with -wait-timeout" => sub {
+    my ($code, $elapsed) = redis_setlock("--redis" => $down, "--wait-timeout" => "2s", "-who", "probe");
+    is $code => 111;
+    ok 1.5 <= $elapsed && $elapsed < 4, "elapsed seconds $elapsed";
+};
+
+done_testing;
@@ -6,10 +6,12 @@ use Test::RedisServer;
 use Net::EmptyPort qw/ empty_port wait_port /;
 use Carp;
 use Test::More;
+use IO::Socket::INET;
+use POSIX ();
 use Time::HiRes qw/ sleep gettimeofday tv_interval /;
 
 use Exporter 'import';
-our @EXPORT_OK = qw/ redis_server redis_setlock /;
+our @EXPORT_OK = qw/ redis_server redis_setlock stub_redis_server /;
 
 sub redis_server {
     my $redis_server;
@@ -24,6 +26,61 @@ sub redis_server {
     return $redis_server;
 }
 
+my %stub_replies = (
+    INFO    => sub { "\$22\r\nredis_version:2.8.19\r\n\r\n" },
+    SET     => sub { "+OK\r\n" },
+    EVAL    => sub { ":1\r\n" },
+    # a fresh server, which does not have any script cached.
+    EVALSHA => sub { "-NOSCRIPT No matching script. Please use EVAL.\r\n" },
+    ASKING  => sub { "+OK\r\n" },
+);
+
+# stub_redis_server(COMMAND => sub { my @command = @_; return raw RESP reply })
+# starts a fake redis-server which replies by the handlers.
+sub stub_redis_server {
+    my %handler = (%stub_replies, @_);
+    my $port = empty_port();
+    my $pid = fork();
+    croak "fork failed: $!" unless defined $pid;
+    if ($pid == 0) {
+        my $server = IO::Socket::INET->new(
+            LocalAddr => "127.0.0.1",
+            LocalPort => $port,
+            Listen    => 5,
+            ReuseAddr => 1,
+        ) or die "listen failed: $!";
+        $SIG{CHLD} = "IGNORE";
+        while (my $client = $server->accept) {
+            next if fork();
+            $client->autoflush(1);
+            while (my $command = read_command($client)) {
+                my $name = uc $command->[0];
+                my $reply = $handler{$name}
+                    ? $handler{$name}->(@$command)
+                    : "-ERR unknown command '$name'\r\n";
+                print $client $reply;
+            }
+            POSIX::_exit(0);
+        }
+        POSIX::_exit(0);
+    }
+    wait_port($port, 10);
+    return t::Util::StubServer->new($pid, $port);
+}
+
+sub read_command {
+    my $sock = shift;
+    defined(my $line = <$sock>) or return;
+    my ($n) = $line =~ /^\*(\d+)/ or return;
+    my @command;
+    for (1 .. $n) {
+        my ($len) = <$sock> =~ /^\$(\d+)/ or return;
+        read($sock, my $arg, $len + 2);
+        push @command, substr($arg, 0, $len);
+    }
+    return \@command;
+}
+
 sub timer(&) {
     my $code_ref = shift;
     my $t0 = [ gettimeofday ];
@@ -88,4 +145,21 @@ sub trim_args {
     return @result;
 }
 
+package t::Util::StubServer;
+
+sub new {
+    my ($class, $pid, $port) = @_;
+    bless { pid => $pid, port => $port, owner => $$ }, $class;
+}
+
+sub port { $_[0]->{port} }
+
+sub DESTROY {
+    my $self = shift;
+    return if $self->{owner} != $$;
+    local $?;    # do not leak the status of the server into our exit code
+    kill TERM => $self->{pid};
+    waitpid $self->{pid}, 0;
+}
+
 1;
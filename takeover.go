@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"os"
+	"syscall"
+)
+
+// TakeoverLUAScript replaces the lock of KEYS[1] only if it still holds
+// ARGV[1], the value of the dead holder read before.
+const TakeoverLUAScript = "if redis.call(\"get\",KEYS[1]) == ARGV[1]\nthen\nredis.call(\"set\",KEYS[1],ARGV[2],\"EX\",ARGV[3])\nreturn 1\nelse\nreturn 0\nend\n"
+
+// takeoverDeadHolder takes over the lock of key held by another, when its
+// holder is a process of this host which does not exist any more, i.e. it
+// crashed without releasing the lock. The holders on the other hosts can
+// not be checked, and are left alone.
+func takeoverDeadHolder(c *RedisConn, opt *Options, key string, token string) (bool, error) {
+	r := c.Cmd("GET", key)
+	if r.Err != nil {
+		return false, r.Err
+	}
+	v, err := r.Str()
+	if err != nil {
+		return false, nil // released in the meantime, to be locked by SET
+	}
+	h := setlock.ParseHolder(v)
+	host, _ := os.Hostname()
+	if h.Host == "" || h.Host != host || h.PID <= 0 || processExists(h.PID) {
+		return false, nil
+	}
+	n, err := c.Cmd("EVAL", TakeoverLUAScript, 1, key, v, newHolder(opt, token).String(), opt.Expires).Int()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil // taken over or released by another
+	}
+	logEvent("warn", key, nil, "took over lock %s from pid %d on %s, which does not exist any more", key, h.PID, h.Host)
+	return true, nil
+}
+
+// processExists tells whether the process pid exists, even if it is not
+// ours to signal.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// newTLSConfig builds the TLS configuration for -tls. ca is a PEM file of the
+// CA certificates to verify the server with (the system roots if empty), and
+// cert and key are a client certificate and its key, if any.
+func newTLSConfig(ca, cert, key string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be given together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+// tlsHandshake starts TLS on conn to addr, within timeout (no limit if zero).
+func tlsHandshake(conn net.Conn, addr string, cfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	tc := tls.Client(conn, cfg)
+	if timeout > 0 {
+		tc.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s: %s", addr, err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
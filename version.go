@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"runtime/debug"
+)
+
+// commit is the commit which the binary was built from, set by
+// -ldflags "-X main.commit=..." in the Makefile and script/build.sh.
+var commit string
+
+// newHolder returns the holder of this process to store in the lock with
+// token, with the version of this binary by -token-include-version.
+func newHolder(opt *Options, token string) setlock.Holder {
+	h := setlock.NewHolder(token)
+	if opt.TokenIncludeVersion {
+		h.Version = buildVersion()
+	}
+	return h
+}
+
+// buildVersion returns Version followed by "+" and the commit which the
+// binary was built from, if it is known. It is commit if set by -ldflags,
+// or the VCS revision stamped by the go command in module mode.
+func buildVersion() string {
+	if commit != "" {
+		return Version + "+" + commit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return Version
+	}
+	var rev, dirty string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+			if len(rev) > 12 {
+				rev = rev[:12]
+			}
+		case "vcs.modified":
+			if s.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if rev == "" {
+		return Version
+	}
+	return Version + "+" + rev + dirty
+}
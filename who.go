@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fujiwara/go-redis-setlock/setlock"
+	"github.com/fzzy/radix/redis"
+	"log"
+	"time"
+)
+
+// runWho prints the holder of the lock of key, decoded from its value.
+// It exits 1 if key is not locked.
+func runWho(opt *Options, key string) int {
+	c, err := connectToReplica(opt)
+	if err != nil {
+		log.Printf("Redis server seems down: %s\n", err)
+		return ExitCodeError
+	}
+	defer c.Close()
+	return printHolder(c, key)
+}
+
+// runCheck tells whether the lock of key is available now, by locking it
+// and releasing it at once without waiting. It exits 0 if it was available,
+// and opt.ExitCode printing the holder if not.
+func runCheck(opt *Options, key string) int {
+	c, err := connectForProbe(opt)
+	if err != nil {
+		logEvent("error", key, err, "Redis server seems down")
+		return ExitCodeError
+	}
+	defer c.Close()
+
+	o := *opt
+	o.Wait = false
+	var token string
+	if o.Shared {
+		token, err = tryGetSharedLock(context.Background(), c, &o, key)
+	} else {
+		_, token, err = tryGetLock(context.Background(), c, &o, []string{key})
+	}
+	switch err {
+	case nil:
+		unlock(c, &o, key, token)
+		fmt.Printf("%s is available\n", key)
+		return 0
+	case setlock.ErrLocked:
+		printHolder(c, key)
+		return opt.ExitCode
+	}
+	logError(key, err)
+	return ExitCodeError
+}
+
+// printHolder prints the holder of the lock of key. It returns 1 if key is
+// not locked.
+func printHolder(c *RedisConn, key string) int {
+	r := c.Cmd("GET", key)
+	if r.Err != nil {
+		log.Printf("could not get %s: %s\n", key, r.Err)
+		return ExitCodeError
+	}
+	if r.Type == redis.NilReply {
+		fmt.Printf("%s is not locked\n", key)
+		return 1
+	}
+	v, _ := r.Str()
+	ttl, _ := c.Cmd("TTL", key).Int()
+	if v == SharedLockValue {
+		n, _ := c.Cmd("ZCOUNT", readersKey(key), unixMilli(time.Now()), "+inf").Int()
+		fmt.Printf("%s is locked shared by %d readers, ttl %ds\n", key, n, ttl)
+		return 0
+	}
+	h := setlock.ParseHolder(v)
+	if h.Host == "" {
+		fmt.Printf("%s is locked by token %s (no holder info), ttl %ds\n", key, h.Token, ttl)
+		return 0
+	}
+	if h.Version != "" {
+		fmt.Printf("%s is locked by pid %d on %s since %s (token %s, version %s), ttl %ds\n", key, h.PID, h.Host, h.Time.Format(time.RFC3339), h.Token, h.Version, ttl)
+		return 0
+	}
+	fmt.Printf("%s is locked by pid %d on %s since %s (token %s), ttl %ds\n", key, h.PID, h.Host, h.Time.Format(time.RFC3339), h.Token, ttl)
+	return 0
+}